@@ -0,0 +1,77 @@
+package kubeforward
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAdaptivePercentile = 99
+	defaultAdaptiveFactor     = 2
+	defaultAdaptiveMin        = 100 * time.Millisecond
+	defaultAdaptiveMax        = 5 * time.Second
+	defaultAdaptiveSamples    = 200
+	// adaptiveMinSamples are needed before the timeout is derived from them, until then Max applies
+	adaptiveMinSamples = 20
+	// adaptiveRecompute is the number of samples after which the timeout is computed again
+	adaptiveRecompute = 10
+)
+
+// AdaptiveTimeoutConfig configures per-upstream read timeouts of `upstream_read_timeout adaptive`.
+type AdaptiveTimeoutConfig struct {
+	// Percentile of the RTTs of the last Samples replies multiplied by Factor is the timeout
+	Percentile float64
+	Factor     float64
+	Min        time.Duration
+	Max        time.Duration
+	Samples    int
+}
+
+// latencyWindow keeps the last RTTs of one upstream and the timeout derived from them.
+type latencyWindow struct {
+	config *AdaptiveTimeoutConfig
+	// current is the timeout in nanoseconds
+	current atomic.Int64
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	added   int
+}
+
+func newLatencyWindow(config *AdaptiveTimeoutConfig) *latencyWindow {
+	w := &latencyWindow{config: config, samples: make([]time.Duration, 0, config.Samples)}
+	w.current.Store(int64(config.Max))
+	return w
+}
+
+// timeout returns the current read timeout of the upstream
+func (w *latencyWindow) timeout() time.Duration {
+	return time.Duration(w.current.Load())
+}
+
+// record adds the RTT of a query and computes the timeout again every adaptiveRecompute samples
+func (w *latencyWindow) record(rtt time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, rtt)
+	} else {
+		w.samples[w.next] = rtt
+		w.next = (w.next + 1) % len(w.samples)
+	}
+	w.added++
+	if len(w.samples) < adaptiveMinSamples || w.added%adaptiveRecompute != 0 {
+		return
+	}
+
+	sorted := slices.Clone(w.samples)
+	slices.Sort(sorted)
+	rank := int(math.Ceil(w.config.Percentile/100*float64(len(sorted)))) - 1
+	timeout := time.Duration(float64(sorted[max(rank, 0)]) * w.config.Factor)
+	w.current.Store(int64(min(max(timeout, w.config.Min), w.config.Max)))
+}
@@ -0,0 +1,89 @@
+package kubeforward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	config := &AdaptiveTimeoutConfig{Percentile: 99, Factor: 2, Min: 100 * time.Millisecond, Max: 5 * time.Second, Samples: 100}
+
+	tests := []struct {
+		name     string
+		samples  []time.Duration
+		expected time.Duration
+	}{
+		{name: "too few samples", samples: repeat(10*time.Millisecond, adaptiveMinSamples-1), expected: 5 * time.Second},
+		{name: "percentile times factor", samples: append(repeat(100*time.Millisecond, 98), time.Second, time.Second), expected: 2 * time.Second},
+		{name: "clamped to min", samples: repeat(time.Millisecond, 100), expected: 100 * time.Millisecond},
+		{name: "clamped to max", samples: repeat(4*time.Second, 100), expected: 5 * time.Second},
+		{name: "old samples dropped", samples: append(repeat(4*time.Second, 100), repeat(200*time.Millisecond, 100)...), expected: 400 * time.Millisecond},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newLatencyWindow(config)
+			for _, rtt := range tc.samples {
+				w.record(rtt)
+			}
+			if timeout := w.timeout(); timeout != tc.expected {
+				t.Errorf("expected timeout %v, got %v", tc.expected, timeout)
+			}
+		})
+	}
+}
+
+func repeat(rtt time.Duration, n int) []time.Duration {
+	samples := make([]time.Duration, n)
+	for i := range samples {
+		samples[i] = rtt
+	}
+	return samples
+}
+
+// stalledUpstream answers only when the context is done
+type stalledUpstream struct {
+	fakeUpstream
+}
+
+func (u *stalledUpstream) Exchange(ctx context.Context, _ request.Request, _ proxy.Options) (*dns.Msg, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestAdaptiveTimeoutAbandonsQuery(t *testing.T) {
+	config := &AdaptiveTimeoutConfig{Percentile: 99, Factor: 2, Min: 10 * time.Millisecond, Max: 5 * time.Second, Samples: 20}
+	u := &endpointUpstream{upstream: &stalledUpstream{fakeUpstream{addr: "10.0.0.1:53"}}, latency: newLatencyWindow(config)}
+	for range 20 {
+		u.latency.record(time.Millisecond)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	if _, err := u.exchange(context.Background(), request.Request{W: &test.ResponseWriter{}, Req: req}, proxy.Options{}); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected query to be abandoned at the adaptive timeout, took %v", elapsed)
+	}
+
+	// Abandoned queries do not raise the timeout, however many there are
+	for range 5 * adaptiveRecompute {
+		if _, err := u.exchange(context.Background(), request.Request{W: &test.ResponseWriter{}, Req: req}, proxy.Options{}); err == nil {
+			t.Fatalf("expected error, got none")
+		}
+	}
+	for range adaptiveRecompute {
+		u.latency.record(time.Millisecond)
+	}
+	if timeout := u.latency.timeout(); timeout != 10*time.Millisecond {
+		t.Errorf("expected timeout to stay at 10ms, got %v", timeout)
+	}
+}
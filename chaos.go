@@ -0,0 +1,83 @@
+package kubeforward
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// chaosZone is the CHAOS class zone answered by kubeforward itself
+const chaosZone = "kubeforward."
+
+// isChaos reports if the query is a CHAOS class introspection query
+func (df *KubeForward) isChaos(state request.Request) bool {
+	return len(df.chaosACL) > 0 && state.QClass() == dns.ClassCHAOS && dns.IsSubDomain(chaosZone, state.Name())
+}
+
+// serveChaos answers version.kubeforward., upstreams.kubeforward. and health.kubeforward.
+// with TXT records to clients allowed by the chaos ACL.
+func (df *KubeForward) serveChaos(w dns.ResponseWriter, state request.Request) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+
+	if !df.chaosAllowed(state.IP()) {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return 0, nil
+	}
+
+	var lines []string
+	switch state.Name() {
+	case "version." + chaosZone:
+		lines = []string{version}
+	case "upstreams." + chaosZone:
+		for _, rt := range df.routes {
+			for _, u := range rt.debugUpstreams(df.transport) {
+				lines = append(lines, fmt.Sprintf("%s %s %s %s pod=%s", strings.Join(rt.zones, ","), u.Address, u.Transport, strings.Join(u.Protocols, ","), u.Pod))
+			}
+		}
+	case "health." + chaosZone:
+		for _, rt := range df.routes {
+			for _, u := range rt.debugUpstreams(df.transport) {
+				health := "healthy"
+				if !u.Healthy {
+					health = "down"
+				}
+				lines = append(lines, fmt.Sprintf("%s %s fails=%d inflight=%d", u.Address, health, u.Fails, u.InFlight))
+			}
+		}
+	default:
+		m.Rcode = dns.RcodeNameError
+		w.WriteMsg(m)
+		return 0, nil
+	}
+
+	if state.QType() == dns.TypeTXT || state.QType() == dns.TypeANY {
+		hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}
+		for _, line := range lines {
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{line}})
+		}
+	}
+
+	w.WriteMsg(state.Scrub(m))
+	return 0, nil
+}
+
+func (df *KubeForward) chaosAllowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range df.chaosACL {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
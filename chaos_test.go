@@ -0,0 +1,100 @@
+package kubeforward
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeChaos(t *testing.T) {
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		remoteIP      string
+		expectedRcode int
+		expectedTxt   []string
+	}{
+		{
+			name:          "Version",
+			qname:         "version.kubeforward.",
+			qtype:         dns.TypeTXT,
+			expectedRcode: dns.RcodeSuccess,
+			expectedTxt:   []string{version},
+		},
+		{
+			name:          "Upstreams",
+			qname:         "Upstreams.Kubeforward.",
+			qtype:         dns.TypeTXT,
+			expectedRcode: dns.RcodeSuccess,
+			expectedTxt:   []string{". 10.0.0.1:53 dns udp,tcp pod=", ". 10.0.0.2:53 dns udp,tcp pod="},
+		},
+		{
+			name:          "Health",
+			qname:         "health.kubeforward.",
+			qtype:         dns.TypeTXT,
+			expectedRcode: dns.RcodeSuccess,
+			expectedTxt:   []string{"10.0.0.1:53 healthy fails=0 inflight=0", "10.0.0.2:53 down fails=2 inflight=0"},
+		},
+		{
+			name:          "Other type gets no data",
+			qname:         "version.kubeforward.",
+			qtype:         dns.TypeA,
+			expectedRcode: dns.RcodeSuccess,
+		},
+		{
+			name:          "Unknown name",
+			qname:         "config.kubeforward.",
+			qtype:         dns.TypeTXT,
+			expectedRcode: dns.RcodeNameError,
+		},
+		{
+			name:          "Client outside of ACL",
+			qname:         "version.kubeforward.",
+			qtype:         dns.TypeTXT,
+			remoteIP:      "192.0.2.1",
+			expectedRcode: dns.RcodeRefused,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down := &fakeUpstream{addr: "10.0.0.2:53", err: errors.New("down"), fails: 2}
+			df := &KubeForward{
+				routes:    []*route{newTestRoute(".", &fakeUpstream{addr: "10.0.0.1:53"}, down)},
+				chaosACL:  []netip.Prefix{netip.MustParsePrefix("10.240.0.0/16")},
+				transport: transport.DNS,
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+			req.Question[0].Qclass = dns.ClassCHAOS
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tt.remoteIP})
+
+			if _, err := df.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Msg == nil {
+				t.Fatalf("expected reply")
+			}
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[tt.expectedRcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+
+			var txt []string
+			for _, rr := range rec.Msg.Answer {
+				txt = append(txt, strings.Join(rr.(*dns.TXT).Txt, ""))
+			}
+			if strings.Join(txt, "\n") != strings.Join(tt.expectedTxt, "\n") {
+				t.Errorf("expected TXT %q, got %q", tt.expectedTxt, txt)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package kubeforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	clientIdentityECS   = "ecs"
+	clientIdentityLocal = "local"
+)
+
+// clientIdentity attaches the client address to queries sent upstream as EDNS0 option,
+// either as EDNS Client Subnet or as a local option carrying the address bytes.
+type clientIdentity struct {
+	mode    string
+	prefix4 uint8
+	prefix6 uint8
+	code    uint16
+}
+
+func (ci *clientIdentity) String() string {
+	if ci.mode == clientIdentityLocal {
+		return fmt.Sprintf("%s %d", ci.mode, ci.code)
+	}
+	return fmt.Sprintf("%s %d %d", ci.mode, ci.prefix4, ci.prefix6)
+}
+
+// attach returns copy of the query with the client address option and a function removing
+// everything added from the reply. Such option sent by the client itself is dropped, so a Pod
+// cannot claim the identity of another one.
+func (ci *clientIdentity) attach(state request.Request) (*dns.Msg, func(ret *dns.Msg)) {
+	req := state.Req.Copy()
+	opt := req.IsEdns0()
+	if opt != nil {
+		opt.Option = removeOption(opt.Option, ci.optionCode())
+	}
+
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return req, func(*dns.Msg) {}
+	}
+
+	option := ci.option(ip)
+	addedOPT := opt == nil
+	if addedOPT {
+		// Client without EDNS0 accepts only 512 bytes over UDP
+		req.SetEdns0(dns.MinMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	opt.Option = append(opt.Option, option)
+
+	return req, func(ret *dns.Msg) {
+		if addedOPT {
+			ret.Extra = removeOPT(ret.Extra)
+			return
+		}
+		if opt := ret.IsEdns0(); opt != nil {
+			opt.Option = removeOption(opt.Option, option.Option())
+		}
+	}
+}
+
+// optionCode is the EDNS0 option code carrying the client address
+func (ci *clientIdentity) optionCode() uint16 {
+	if ci.mode == clientIdentityLocal {
+		return ci.code
+	}
+	return dns.EDNS0SUBNET
+}
+
+func (ci *clientIdentity) option(ip net.IP) dns.EDNS0 {
+	if ci.mode == clientIdentityLocal {
+		data := ip.To4()
+		if data == nil {
+			data = ip.To16()
+		}
+		return &dns.EDNS0_LOCAL{Code: ci.code, Data: data}
+	}
+
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.SourceNetmask = ci.prefix4
+		ecs.Address = ip4.Mask(net.CIDRMask(int(ci.prefix4), net.IPv4len*8))
+	} else {
+		ecs.Family = 2
+		ecs.SourceNetmask = ci.prefix6
+		ecs.Address = ip.Mask(net.CIDRMask(int(ci.prefix6), net.IPv6len*8))
+	}
+
+	return ecs
+}
+
+func removeOPT(extra []dns.RR) []dns.RR {
+	filtered := extra[:0]
+	for _, rr := range extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+func removeOption(options []dns.EDNS0, code uint16) []dns.EDNS0 {
+	filtered := options[:0]
+	for _, o := range options {
+		if o.Option() != code {
+			filtered = append(filtered, o)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,91 @@
+package kubeforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestClientIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity clientIdentity
+		edns     bool
+		spoofed  dns.EDNS0
+		expected dns.EDNS0
+	}{
+		{
+			name:     "ECS with prefix",
+			identity: clientIdentity{mode: clientIdentityECS, prefix4: 24, prefix6: 56},
+			expected: &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.240.0.0").To4()},
+		},
+		{
+			name:     "Local option for client with EDNS0",
+			identity: clientIdentity{mode: clientIdentityLocal, code: 65500},
+			edns:     true,
+			expected: &dns.EDNS0_LOCAL{Code: 65500, Data: net.ParseIP("10.240.0.1").To4()},
+		},
+		{
+			name:     "Spoofed ECS replaced",
+			identity: clientIdentity{mode: clientIdentityECS, prefix4: 32, prefix6: 128},
+			edns:     true,
+			spoofed:  &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("10.240.0.99").To4()},
+			expected: &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("10.240.0.1").To4()},
+		},
+		{
+			name:     "Spoofed local option replaced",
+			identity: clientIdentity{mode: clientIdentityLocal, code: 65500},
+			edns:     true,
+			spoofed:  &dns.EDNS0_LOCAL{Code: 65500, Data: net.ParseIP("10.240.0.99").To4()},
+			expected: &dns.EDNS0_LOCAL{Code: 65500, Data: net.ParseIP("10.240.0.1").To4()},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("example.org.", dns.TypeA)
+			if tc.edns {
+				req.SetEdns0(4096, false)
+			}
+			if tc.spoofed != nil {
+				req.IsEdns0().Option = append(req.IsEdns0().Option, tc.spoofed)
+			}
+			// test.ResponseWriter reports client 10.240.0.1
+			state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+			upstreamReq, strip := tc.identity.attach(state)
+
+			opt := upstreamReq.IsEdns0()
+			if opt == nil || len(opt.Option) != 1 {
+				t.Fatalf("expected one EDNS0 option in upstream query, got %v", opt)
+			}
+			if opt.Option[0].String() != tc.expected.String() {
+				t.Errorf("expected option %s, got %s", tc.expected, opt.Option[0])
+			}
+			if clientOpt := req.IsEdns0(); clientOpt != nil && len(clientOpt.Option) != 0 && clientOpt.Option[0] != tc.spoofed {
+				t.Errorf("expected client query to stay unchanged, got %v", clientOpt)
+			}
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			ret := new(dns.Msg)
+			ret.SetReply(upstreamReq)
+			// Upstream echoes the OPT record with the option
+			ret.Extra = append(ret.Extra, dns.Copy(opt))
+			strip(ret)
+			rec.WriteMsg(ret)
+
+			retOpt := rec.Msg.IsEdns0()
+			if tc.edns && (retOpt == nil || len(retOpt.Option) != 0) {
+				t.Errorf("expected OPT without options in reply, got %v", retOpt)
+			}
+			if !tc.edns && retOpt != nil {
+				t.Errorf("expected no OPT in reply to client without EDNS0, got %v", retOpt)
+			}
+		})
+	}
+}
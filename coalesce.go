@@ -0,0 +1,114 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// coalesceKey identifies queries that get the same reply from upstreams
+type coalesceKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+	rd     bool
+	proto  string
+	// size is the advertised UDP buffer size, the reply must fit the one of every waiter
+	size int
+	// edns is the OPT record of the query with its options, the reply echoes them
+	edns string
+	// client is set when client_identity attaches the client address to the query
+	client string
+}
+
+// coalescedCall is a query forwarded on behalf of all identical queries that arrive while it is in flight
+type coalescedCall struct {
+	done   chan struct{}
+	ret    *dns.Msg
+	result forwardResult
+	err    error
+}
+
+// coalescer forwards one of identical in-flight queries and fans the reply out to the others.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[coalesceKey]*coalescedCall
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[coalesceKey]*coalescedCall)}
+}
+
+func (df *KubeForward) coalesceKey(state request.Request) coalesceKey {
+	key := coalesceKey{
+		name:   state.Name(),
+		qtype:  state.QType(),
+		qclass: state.QClass(),
+		do:     state.Do(),
+		cd:     state.Req.CheckingDisabled,
+		rd:     state.Req.RecursionDesired,
+		proto:  state.Proto(),
+		size:   state.Size(),
+		edns:   ednsKey(state.Req),
+	}
+	if df.clientIdentity != nil {
+		key.client = state.IP()
+	}
+	return key
+}
+
+// ednsKey describes the OPT record of the query: none, or its options like cookies and ECS.
+// Queries without EDNS must not get the OPT of another one.
+func ednsKey(req *dns.Msg) string {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	var key strings.Builder
+	key.WriteString("opt")
+	for _, o := range opt.Option {
+		fmt.Fprintf(&key, ";%d:%s", o.Option(), o)
+	}
+	return key.String()
+}
+
+// do calls forward unless an identical query is in flight already, then it waits for its reply.
+// Every caller gets its own copy of the reply with its message ID and question.
+func (c *coalescer) do(ctx context.Context, key coalesceKey, req *dns.Msg, forward func() (*dns.Msg, forwardResult, error)) (ret *dns.Msg, result forwardResult, coalesced bool, err error) {
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+	}
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, forwardResult{}, true, ctx.Err()
+		}
+	} else {
+		call.ret, call.result, call.err = forward()
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}
+
+	if call.err != nil {
+		return nil, call.result, ok, call.err
+	}
+	ret = call.ret.Copy()
+	ret.Id = req.Id
+	ret.Question = append([]dns.Question(nil), req.Question...)
+
+	return ret, call.result, ok, nil
+}
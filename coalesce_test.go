@@ -0,0 +1,142 @@
+package kubeforward
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// blockingUpstream answers queries after release is closed and counts them
+type blockingUpstream struct {
+	fakeUpstream
+	release chan struct{}
+	queries atomic.Int32
+}
+
+func (u *blockingUpstream) Exchange(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	u.queries.Add(1)
+	<-u.release
+	return u.fakeUpstream.Exchange(ctx, state, opts)
+}
+
+func TestServeDNSCoalesce(t *testing.T) {
+	u := &blockingUpstream{fakeUpstream: fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeSuccess}, release: make(chan struct{})}
+	kf := &KubeForward{
+		Next:      test.NextHandler(dns.RcodeSuccess, nil),
+		routes:    []*route{newTestRoute(".", u)},
+		coalescer: newCoalescer(),
+	}
+
+	const waiters = 5
+	replies := make([]*dns.Msg, waiters)
+	var wg sync.WaitGroup
+	for i := range waiters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			// Case of the name does not matter, every client gets its own question back
+			if i%2 == 0 {
+				req.SetQuestion("example.org.", dns.TypeA)
+			} else {
+				req.SetQuestion("Example.ORG.", dns.TypeA)
+			}
+			req.Id = uint16(1000 + i)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := kf.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			replies[i] = rec.Msg
+		}()
+	}
+
+	// Wait until all the queries joined the first one
+	for {
+		kf.coalescer.mu.Lock()
+		call := kf.coalescer.calls[coalesceKey{name: "example.org.", qtype: dns.TypeA, qclass: dns.ClassINET, rd: true, proto: "udp", size: dns.MinMsgSize}]
+		kf.coalescer.mu.Unlock()
+		if call != nil && u.queries.Load() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(u.release)
+	wg.Wait()
+
+	if n := u.queries.Load(); n != 1 {
+		t.Errorf("expected 1 query forwarded, got %d", n)
+	}
+	for i, reply := range replies {
+		if reply == nil {
+			t.Fatalf("waiter %d: expected reply, got none", i)
+		}
+		if reply.Id != uint16(1000+i) {
+			t.Errorf("waiter %d: expected id %d, got %d", i, 1000+i, reply.Id)
+		}
+		expectedName := "example.org."
+		if i%2 == 1 {
+			expectedName = "Example.ORG."
+		}
+		if reply.Question[0].Name != expectedName {
+			t.Errorf("waiter %d: expected question %s, got %s", i, expectedName, reply.Question[0].Name)
+		}
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	query := func(name string, do bool) request.Request {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		if do {
+			req.SetEdns0(4096, true)
+		}
+		return request.Request{W: &test.ResponseWriter{}, Req: req}
+	}
+
+	kf := &KubeForward{}
+	if kf.coalesceKey(query("example.org.", false)) != kf.coalesceKey(query("EXAMPLE.org.", false)) {
+		t.Errorf("expected queries differing in name case to be coalesced")
+	}
+	if kf.coalesceKey(query("example.org.", false)) == kf.coalesceKey(query("example.org.", true)) {
+		t.Errorf("expected queries differing in DO bit not to be coalesced")
+	}
+
+	tcp := query("example.org.", false)
+	tcp.W = &test.ResponseWriter{TCP: true}
+	if kf.coalesceKey(query("example.org.", false)) == kf.coalesceKey(tcp) {
+		t.Errorf("expected queries over different protocols not to be coalesced")
+	}
+
+	// EDNS without DO and no EDNS at all both advertise 512 bytes
+	edns := query("example.org.", false)
+	edns.Req.SetEdns0(dns.MinMsgSize, false)
+	if kf.coalesceKey(query("example.org.", false)) == kf.coalesceKey(edns) {
+		t.Errorf("expected queries with and without EDNS not to be coalesced")
+	}
+	cookie := query("example.org.", false)
+	cookie.Req.SetEdns0(dns.MinMsgSize, false)
+	cookie.Req.IsEdns0().Option = append(cookie.Req.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	if kf.coalesceKey(edns) == kf.coalesceKey(cookie) {
+		t.Errorf("expected queries with different EDNS options not to be coalesced")
+	}
+
+	other := query("example.org.", false)
+	other.W = &test.ResponseWriter{RemoteIP: "10.0.0.2"}
+	if kf.coalesceKey(query("example.org.", false)) != kf.coalesceKey(other) {
+		t.Errorf("expected queries of different clients to be coalesced")
+	}
+	// The client address is attached to the query with client_identity
+	kf.clientIdentity = &clientIdentity{mode: clientIdentityECS}
+	if kf.coalesceKey(query("example.org.", false)) == kf.coalesceKey(other) {
+		t.Errorf("expected queries of different clients not to be coalesced with client_identity")
+	}
+}
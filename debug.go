@@ -0,0 +1,154 @@
+package kubeforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	v1 "k8s.io/api/discovery/v1"
+)
+
+// debugUpstream is the state of one upstream served at /upstreams
+type debugUpstream struct {
+	Address   string   `json:"address"`
+	Transport string   `json:"transport"`
+	Protocols []string `json:"protocols"`
+	Pod       string   `json:"pod,omitempty"`
+	Node      string   `json:"node,omitempty"`
+	Zone      string   `json:"zone,omitempty"`
+	Healthy   bool     `json:"healthy"`
+	Fails     uint32   `json:"fails"`
+	Ejected   bool     `json:"ejected,omitempty"`
+	InFlight  int64    `json:"inFlight"`
+	LastRTT   string   `json:"lastRTT,omitempty"`
+	Timeout   string   `json:"timeout,omitempty"`
+}
+
+// debugRoute groups upstreams and EndpointSlices of one route
+type debugRoute struct {
+	Zones       []string            `json:"zones"`
+	Namespace   string              `json:"namespace"`
+	ServiceName string              `json:"serviceName"`
+	Upstreams   []debugUpstream     `json:"upstreams,omitempty"`
+	Slices      []*v1.EndpointSlice `json:"slices,omitempty"`
+}
+
+// debugConfig is the effective config served at /config
+type debugConfig struct {
+	*KubeForwardConfig
+	TLS            bool             `json:"TLS"`
+	HealthCheck    debugHealthCheck `json:"HealthCheck"`
+	ClientIdentity string           `json:"ClientIdentity,omitempty"`
+}
+
+// debugHealthCheck is the health check part of proxy options with the active health check config
+type debugHealthCheck struct {
+	proxy.Options
+	Active *HealthCheckConfig `json:",omitempty"`
+}
+
+// debugHandler serves what kubeforward currently believes as JSON:
+// /upstreams, /slices and /config.
+func (df *KubeForward) debugHandler(config *KubeForwardConfig) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		routes := make([]debugRoute, 0, len(df.routes))
+		for _, rt := range df.routes {
+			routes = append(routes, debugRoute{
+				Zones:       rt.zones,
+				Namespace:   rt.namespace,
+				ServiceName: rt.serviceName,
+				Upstreams:   rt.debugUpstreams(config.Transport),
+			})
+		}
+		writeJSON(w, routes)
+	})
+
+	mux.HandleFunc("/slices", func(w http.ResponseWriter, r *http.Request) {
+		routes := make([]debugRoute, 0, len(df.routes))
+		for _, rt := range df.routes {
+			route := debugRoute{Zones: rt.zones, Namespace: rt.namespace, ServiceName: rt.serviceName}
+			for _, item := range rt.slices.List() {
+				if endpointSlice, ok := item.(*v1.EndpointSlice); ok {
+					route.Slices = append(route.Slices, endpointSlice)
+				}
+			}
+			routes = append(routes, route)
+		}
+		writeJSON(w, routes)
+	})
+
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		effective := debugConfig{
+			KubeForwardConfig: config,
+			TLS:               config.TLSConfig != nil,
+			HealthCheck:       debugHealthCheck{Options: config.opts, Active: config.HealthCheck},
+		}
+		if config.clientIdentity != nil {
+			effective.ClientIdentity = config.clientIdentity.String()
+		}
+		writeJSON(w, effective)
+	})
+
+	return mux
+}
+
+// debugUpstreams returns state of the current upstreams of the route
+func (rt *route) debugUpstreams(defaultTransport string) []debugUpstream {
+	rt.mu.Lock()
+	upstreams := rt.upstreams
+	rt.mu.Unlock()
+
+	if upstreams == nil {
+		return nil
+	}
+
+	list := make([]debugUpstream, 0, len(upstreams.udp)+len(upstreams.tcp))
+	for _, u := range upstreams.all() {
+		state := debugUpstream{
+			Address:   u.Addr(),
+			Transport: endpointTransport(u.endpoint.AppProtocol, rt.transport(defaultTransport)),
+			Pod:       u.endpoint.Pod,
+			Node:      u.endpoint.NodeName,
+			Zone:      u.endpoint.Zone,
+			Healthy:   !u.Down(maxFails),
+			Fails:     u.Fails(),
+			Ejected:   u.ejected(),
+			InFlight:  u.inflight.Load(),
+		}
+		for _, proto := range []string{"udp", "tcp"} {
+			if upstreams.serves(u, proto) {
+				state.Protocols = append(state.Protocols, proto)
+			}
+		}
+		if rtt := u.lastRTT.Load(); rtt > 0 {
+			state.LastRTT = time.Duration(rtt).String()
+		}
+		if u.latency != nil {
+			state.Timeout = u.latency.timeout().String()
+		}
+		list = append(list, state)
+	}
+
+	return list
+}
+
+// serves reports if the upstream is used for queries over proto
+func (s *upstreamSet) serves(u *endpointUpstream, proto string) bool {
+	if proto == "tcp" {
+		return slices.Contains(s.tcp, u)
+	}
+	return slices.Contains(s.udp, u)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		clogger.Errorf("failed to write debug response: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package kubeforward
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	v1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDebugHandler(t *testing.T) {
+	rt := newTestRoute(".", &fakeUpstream{addr: "10.0.0.1:53"}, &fakeUpstream{addr: "10.0.0.2:53", err: errors.New("down")})
+	rt.namespace, rt.serviceName = "kube-system", "d8-kube-dns"
+	rt.upstreams.udp[0].endpoint.Pod = "d8-kube-dns-abc"
+	rt.slices.Add(&v1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "d8-kube-dns-xyz"}})
+
+	config := &KubeForwardConfig{Namespace: "kube-system", ServiceName: "d8-kube-dns", Transport: transport.DNS, clientIdentity: &clientIdentity{mode: clientIdentityECS, prefix4: 24, prefix6: 56}}
+	df := &KubeForward{routes: []*route{rt}}
+
+	srv := httptest.NewServer(df.debugHandler(config))
+	defer srv.Close()
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: unexpected status %d", path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: failed to decode: %v", path, err)
+		}
+	}
+
+	var upstreams []debugRoute
+	get("/upstreams", &upstreams)
+	if len(upstreams) != 1 || len(upstreams[0].Upstreams) != 2 {
+		t.Fatalf("unexpected upstreams: %+v", upstreams)
+	}
+	first := upstreams[0].Upstreams[0]
+	if first.Address != "10.0.0.1:53" || first.Pod != "d8-kube-dns-abc" || first.Transport != transport.DNS || !first.Healthy {
+		t.Errorf("unexpected upstream: %+v", first)
+	}
+	if len(first.Protocols) != 2 {
+		t.Errorf("expected upstream used for udp and tcp, got %v", first.Protocols)
+	}
+
+	var slices []debugRoute
+	get("/slices", &slices)
+	if len(slices) != 1 || len(slices[0].Slices) != 1 || slices[0].Slices[0].Name != "d8-kube-dns-xyz" {
+		t.Errorf("unexpected slices: %+v", slices)
+	}
+
+	var effective map[string]interface{}
+	get("/config", &effective)
+	if effective["Namespace"] != "kube-system" || effective["ClientIdentity"] != "ecs 24 56" || effective["TLS"] != false {
+		t.Errorf("unexpected config: %v", effective)
+	}
+}
@@ -0,0 +1,81 @@
+package kubeforward
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// setTapPlugin appends the dnstap plugin and the ones chained after it, as forward does.
+func (df *KubeForward) setTapPlugin(tapPlugin *dnstap.Dnstap) {
+	df.tapPlugins = append(df.tapPlugins, tapPlugin)
+	if nextPlugin, ok := tapPlugin.Next.(*dnstap.Dnstap); ok {
+		df.setTapPlugin(nextPlugin)
+	}
+}
+
+// toDnstap sends FORWARDER_QUERY and FORWARDER_RESPONSE messages of one attempt
+// with the upstream endpoint as response address to the dnstap plugins.
+func (df *KubeForward) toDnstap(ctx context.Context, upstreamAddr string, state request.Request, opts proxy.Options, reply *dns.Msg, start time.Time) {
+	for _, t := range df.tapPlugins {
+		for _, m := range forwarderMessages(upstreamAddr, state, opts, reply, start, t.IncludeRawMessage) {
+			t.TapMessageWithMetadata(ctx, m, state)
+		}
+	}
+}
+
+// forwarderMessages builds dnstap messages of the query sent to upstreamAddr and of its reply, if any.
+func forwarderMessages(upstreamAddr string, state request.Request, opts proxy.Options, reply *dns.Msg, start time.Time, includeRaw bool) []*tap.Message {
+	ap, err := netip.ParseAddrPort(upstreamAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.IP(ap.Addr().AsSlice())
+	port := int(ap.Port())
+
+	var ta net.Addr = &net.UDPAddr{IP: ip, Port: port}
+	proto := state.Proto()
+	switch {
+	case opts.ForceTCP:
+		proto = "tcp"
+	case opts.PreferUDP:
+		proto = "udp"
+	}
+	if proto == "tcp" {
+		ta = &net.TCPAddr{IP: ip, Port: port}
+	}
+
+	// Forwarder dnstap messages are from the perspective of the downstream server
+	q := new(tap.Message)
+	msg.SetQueryTime(q, start)
+	msg.SetQueryAddress(q, state.W.RemoteAddr())
+	msg.SetResponseAddress(q, ta)
+	if includeRaw {
+		q.QueryMessage, _ = state.Req.Pack()
+	}
+	msg.SetType(q, tap.Message_FORWARDER_QUERY)
+	messages := []*tap.Message{q}
+
+	if reply != nil {
+		r := new(tap.Message)
+		if includeRaw {
+			r.ResponseMessage, _ = reply.Pack()
+		}
+		msg.SetQueryTime(r, start)
+		msg.SetQueryAddress(r, state.W.RemoteAddr())
+		msg.SetResponseAddress(r, ta)
+		msg.SetResponseTime(r, time.Now())
+		msg.SetType(r, tap.Message_FORWARDER_RESPONSE)
+		messages = append(messages, r)
+	}
+
+	return messages
+}
@@ -0,0 +1,97 @@
+package kubeforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+func TestForwarderMessages(t *testing.T) {
+	tests := []struct {
+		name             string
+		upstreamAddr     string
+		clientTCP        bool
+		opts             proxy.Options
+		reply            bool
+		includeRaw       bool
+		expectedTypes    []tap.Message_Type
+		expectedProtocol tap.SocketProtocol
+		expectedFamily   tap.SocketFamily
+	}{
+		{
+			name:             "Query and response over UDP",
+			upstreamAddr:     "10.0.0.1:53",
+			reply:            true,
+			expectedTypes:    []tap.Message_Type{tap.Message_FORWARDER_QUERY, tap.Message_FORWARDER_RESPONSE},
+			expectedProtocol: tap.SocketProtocol_UDP,
+			expectedFamily:   tap.SocketFamily_INET,
+		},
+		{
+			name:             "Failed query has no response",
+			upstreamAddr:     "10.0.0.1:53",
+			expectedTypes:    []tap.Message_Type{tap.Message_FORWARDER_QUERY},
+			expectedProtocol: tap.SocketProtocol_UDP,
+			expectedFamily:   tap.SocketFamily_INET,
+		},
+		{
+			name:             "force_tcp to IPv6 upstream",
+			upstreamAddr:     "[fd00::1]:53",
+			opts:             proxy.Options{ForceTCP: true},
+			reply:            true,
+			includeRaw:       true,
+			expectedTypes:    []tap.Message_Type{tap.Message_FORWARDER_QUERY, tap.Message_FORWARDER_RESPONSE},
+			expectedProtocol: tap.SocketProtocol_TCP,
+			expectedFamily:   tap.SocketFamily_INET6,
+		},
+		{
+			name:             "prefer_udp for TCP client",
+			upstreamAddr:     "10.0.0.1:53",
+			clientTCP:        true,
+			opts:             proxy.Options{PreferUDP: true},
+			expectedTypes:    []tap.Message_Type{tap.Message_FORWARDER_QUERY},
+			expectedProtocol: tap.SocketProtocol_UDP,
+			expectedFamily:   tap.SocketFamily_INET,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("example.org.", dns.TypeA)
+			state := request.Request{W: &test.ResponseWriter{TCP: tt.clientTCP}, Req: req}
+
+			var reply *dns.Msg
+			if tt.reply {
+				reply = new(dns.Msg)
+				reply.SetReply(req)
+			}
+
+			messages := forwarderMessages(tt.upstreamAddr, state, tt.opts, reply, time.Now(), tt.includeRaw)
+			if len(messages) != len(tt.expectedTypes) {
+				t.Fatalf("expected %d messages, got %d", len(tt.expectedTypes), len(messages))
+			}
+
+			host, _, _ := net.SplitHostPort(tt.upstreamAddr)
+			for i, m := range messages {
+				if m.GetType() != tt.expectedTypes[i] {
+					t.Errorf("expected type %v, got %v", tt.expectedTypes[i], m.GetType())
+				}
+				if net.IP(m.GetResponseAddress()).String() != host || m.GetResponsePort() != 53 {
+					t.Errorf("expected response address %s, got %v:%d", tt.upstreamAddr, net.IP(m.GetResponseAddress()), m.GetResponsePort())
+				}
+				if m.GetSocketProtocol() != tt.expectedProtocol || m.GetSocketFamily() != tt.expectedFamily {
+					t.Errorf("expected %v/%v, got %v/%v", tt.expectedProtocol, tt.expectedFamily, m.GetSocketProtocol(), m.GetSocketFamily())
+				}
+				if tt.includeRaw != (len(m.GetQueryMessage())+len(m.GetResponseMessage()) > 0) {
+					t.Errorf("expected raw message included %v", tt.includeRaw)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultEmergencyZone = "cluster.local."
+	defaultEmergencyTTL  = 5
+	// sliceServiceIndex indexes EndpointSlices by namespace/service
+	sliceServiceIndex = "service"
+)
+
+// EmergencyConfig configures local answers of emergency.
+type EmergencyConfig struct {
+	// Zone is the cluster domain, Services are answered under svc.Zone
+	Zone string
+	TTL  uint32
+}
+
+// emergencyResolver answers Service queries from the API when no upstream is healthy,
+// the way the kubernetes plugin does.
+type emergencyResolver struct {
+	zone     string
+	ttl      uint32
+	services cache.Store
+	// slices of headless Services
+	slices cache.Indexer
+	log    *logger
+	// synced is set once the watched objects are listed, nothing is answered before
+	synced atomic.Bool
+	// active is set while queries are answered locally
+	active atomic.Bool
+}
+
+func newEmergencyResolver(config *EmergencyConfig, log *logger) *emergencyResolver {
+	return &emergencyResolver{
+		zone:     config.Zone,
+		ttl:      config.TTL,
+		services: cache.NewStore(cache.MetaNamespaceKeyFunc),
+		slices:   cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{sliceServiceIndex: sliceService}),
+		log:      log,
+	}
+}
+
+func sliceService(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + slice.Labels[discoveryv1.LabelServiceName]}, nil
+}
+
+// start watches Services and EndpointSlices of headless Services in all namespaces
+func (e *emergencyResolver) start(ctx context.Context) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("failed to create in-cluster config for emergency: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client for emergency: %w", err)
+	}
+
+	services := cache.NewListWatchFromClient(clientset.CoreV1().RESTClient(), "services", metav1.NamespaceAll, nil)
+	slices := cache.NewFilteredListWatchFromClient(clientset.DiscoveryV1().RESTClient(), "endpointslices", metav1.NamespaceAll, func(options *metav1.ListOptions) {
+		options.LabelSelector = corev1.IsHeadlessService
+	})
+
+	var synced []cache.InformerSynced
+	for _, watched := range []struct {
+		listWatch cache.ListerWatcher
+		object    runtime.Object
+		store     cache.Store
+	}{
+		{listWatch: services, object: &corev1.Service{}, store: e.services},
+		{listWatch: slices, object: &discoveryv1.EndpointSlice{}, store: e.slices},
+	} {
+		_, controller := cache.NewInformerWithOptions(cache.InformerOptions{
+			ListerWatcher: watched.listWatch,
+			ObjectType:    watched.object,
+			Handler:       mirrorHandler(watched.store, e.log),
+		})
+		go controller.Run(ctx.Done())
+		synced = append(synced, controller.HasSynced)
+	}
+
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return fmt.Errorf("failed to sync emergency informers")
+	}
+	e.synced.Store(true)
+	e.log.Infof("emergency watchers of Services for zone %s are running", e.zone)
+
+	return nil
+}
+
+// mirrorHandler keeps store in sync with the watched objects
+func mirrorHandler(store cache.Store, log *logger) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if err := store.Add(obj); err != nil {
+				log.Errorf("failed to add %T: %v", obj, err)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if err := store.Update(obj); err != nil {
+				log.Errorf("failed to update %T: %v", obj, err)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if err := store.Delete(obj); err != nil {
+				log.Errorf("failed to delete %T: %v", obj, err)
+			}
+		},
+	}
+}
+
+// answer builds the reply for a query under svc.<zone>, ok is false for other queries
+func (e *emergencyResolver) answer(state request.Request) (m *dns.Msg, ok bool) {
+	qname := state.Name()
+	svcZone := "svc." + e.zone
+	if !e.synced.Load() || state.QClass() != dns.ClassINET || !dns.IsSubDomain(svcZone, qname) {
+		return nil, false
+	}
+
+	m = new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+
+	// Labels below svc.<zone>, e.g. [http _tcp my-svc default]
+	labels := dns.SplitDomainName(strings.TrimSuffix(qname, svcZone))
+	var (
+		answer []dns.RR
+		exists = true
+	)
+	switch len(labels) {
+	case 0, 1:
+		// svc.<zone> and <namespace>.svc.<zone> have no records
+	case 2:
+		answer, exists = e.serviceRecords(labels[1], labels[0], qname, state.QType())
+	case 3:
+		answer, exists = e.endpointRecords(labels[2], labels[1], labels[0], qname, state.QType())
+	case 4:
+		answer, exists = e.srvRecords(labels[3], labels[2], labels[0], labels[1], qname, state.QType())
+	default:
+		exists = false
+	}
+
+	m.Answer = answer
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(answer) == 0 {
+		m.Ns = []dns.RR{e.soa()}
+	}
+
+	return m, true
+}
+
+// serviceRecords answers <service>.<namespace>.svc.<zone>
+func (e *emergencyResolver) serviceRecords(namespace, name, qname string, qtype uint16) ([]dns.RR, bool) {
+	svc := e.service(namespace, name)
+	if svc == nil {
+		return nil, false
+	}
+
+	switch {
+	case svc.Spec.Type == corev1.ServiceTypeExternalName:
+		return []dns.RR{&dns.CNAME{Hdr: e.header(qname, dns.TypeCNAME), Target: dns.Fqdn(svc.Spec.ExternalName)}}, true
+	case svc.Spec.ClusterIP == corev1.ClusterIPNone:
+		if qtype == dns.TypeSRV {
+			return e.headlessSRV(namespace, name, "", "", qname), true
+		}
+		var answer []dns.RR
+		for _, endpoint := range e.endpoints(namespace, name) {
+			for _, address := range endpoint.Addresses {
+				if rr := e.addressRecord(qname, address, qtype); rr != nil {
+					answer = append(answer, rr)
+				}
+			}
+		}
+		return answer, true
+	default:
+		var answer []dns.RR
+		for _, ip := range svc.Spec.ClusterIPs {
+			if rr := e.addressRecord(qname, ip, qtype); rr != nil {
+				answer = append(answer, rr)
+			}
+		}
+		if qtype == dns.TypeSRV {
+			target := dns.Fqdn(name + "." + namespace + ".svc." + e.zone)
+			for _, port := range svc.Spec.Ports {
+				answer = append(answer, e.srv(qname, target, port.Port))
+			}
+		}
+		return answer, true
+	}
+}
+
+// endpointRecords answers <hostname>.<service>.<namespace>.svc.<zone> of headless Services,
+// endpoints without hostname are named by their dashed address
+func (e *emergencyResolver) endpointRecords(namespace, name, host, qname string, qtype uint16) ([]dns.RR, bool) {
+	exists := false
+	var answer []dns.RR
+	for _, endpoint := range e.endpoints(namespace, name) {
+		for _, address := range endpoint.Addresses {
+			if endpointName(endpoint, address) != host {
+				continue
+			}
+			exists = true
+			if rr := e.addressRecord(qname, address, qtype); rr != nil {
+				answer = append(answer, rr)
+			}
+		}
+	}
+
+	return answer, exists
+}
+
+// srvRecords answers _<port>._<protocol>.<service>.<namespace>.svc.<zone>
+func (e *emergencyResolver) srvRecords(namespace, name, port, protocol, qname string, qtype uint16) ([]dns.RR, bool) {
+	if !strings.HasPrefix(port, "_") || !strings.HasPrefix(protocol, "_") {
+		return nil, false
+	}
+	port, protocol = port[1:], protocol[1:]
+
+	svc := e.service(namespace, name)
+	if svc == nil || svc.Spec.Type == corev1.ServiceTypeExternalName {
+		return nil, false
+	}
+
+	if svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		answer := e.headlessSRV(namespace, name, port, protocol, qname)
+		if qtype != dns.TypeSRV {
+			return nil, len(answer) > 0
+		}
+		return answer, len(answer) > 0
+	}
+
+	var answer []dns.RR
+	target := dns.Fqdn(name + "." + namespace + ".svc." + e.zone)
+	for _, p := range svc.Spec.Ports {
+		if p.Name == port && strings.EqualFold(string(p.Protocol), protocol) {
+			answer = append(answer, e.srv(qname, target, p.Port))
+		}
+	}
+	if qtype != dns.TypeSRV {
+		return nil, len(answer) > 0
+	}
+	return answer, len(answer) > 0
+}
+
+// headlessSRV returns SRV records of every endpoint port, or of the port with the name and protocol
+func (e *emergencyResolver) headlessSRV(namespace, name, port, protocol, qname string) []dns.RR {
+	var answer []dns.RR
+	for _, slice := range e.serviceSlices(namespace, name) {
+		for _, p := range slice.Ports {
+			if p.Port == nil {
+				continue
+			}
+			if port != "" && (p.Name == nil || *p.Name != port || p.Protocol == nil || !strings.EqualFold(string(*p.Protocol), protocol)) {
+				continue
+			}
+			for _, endpoint := range slice.Endpoints {
+				if !endpointReady(endpoint) {
+					continue
+				}
+				for _, address := range endpoint.Addresses {
+					target := dns.Fqdn(endpointName(endpoint, address) + "." + name + "." + namespace + ".svc." + e.zone)
+					answer = append(answer, e.srv(qname, target, *p.Port))
+				}
+			}
+		}
+	}
+
+	return answer
+}
+
+func (e *emergencyResolver) service(namespace, name string) *corev1.Service {
+	obj, exists, err := e.services.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	svc, _ := obj.(*corev1.Service)
+	return svc
+}
+
+func (e *emergencyResolver) serviceSlices(namespace, name string) []*discoveryv1.EndpointSlice {
+	items, err := e.slices.ByIndex(sliceServiceIndex, namespace+"/"+name)
+	if err != nil {
+		return nil
+	}
+	slices := make([]*discoveryv1.EndpointSlice, 0, len(items))
+	for _, item := range items {
+		if slice, ok := item.(*discoveryv1.EndpointSlice); ok {
+			slices = append(slices, slice)
+		}
+	}
+	return slices
+}
+
+// endpoints returns ready endpoints of the headless Service
+func (e *emergencyResolver) endpoints(namespace, name string) []discoveryv1.Endpoint {
+	var endpoints []discoveryv1.Endpoint
+	for _, slice := range e.serviceSlices(namespace, name) {
+		for _, endpoint := range slice.Endpoints {
+			if endpointReady(endpoint) {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	return endpoints
+}
+
+// endpointReady treats unknown readiness as ready, as EndpointSlice API suggests
+func endpointReady(endpoint discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+func endpointName(endpoint discoveryv1.Endpoint, address string) string {
+	if endpoint.Hostname != nil && *endpoint.Hostname != "" {
+		return *endpoint.Hostname
+	}
+	return strings.NewReplacer(".", "-", ":", "-").Replace(address)
+}
+
+func (e *emergencyResolver) header(qname string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: qname, Rrtype: rrtype, Class: dns.ClassINET, Ttl: e.ttl}
+}
+
+// addressRecord returns A or AAAA record of the address matching qtype, nil otherwise
+func (e *emergencyResolver) addressRecord(qname, address string, qtype uint16) dns.RR {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return nil
+	case ip.To4() != nil && qtype == dns.TypeA:
+		return &dns.A{Hdr: e.header(qname, dns.TypeA), A: ip.To4()}
+	case ip.To4() == nil && qtype == dns.TypeAAAA:
+		return &dns.AAAA{Hdr: e.header(qname, dns.TypeAAAA), AAAA: ip}
+	default:
+		return nil
+	}
+}
+
+func (e *emergencyResolver) srv(qname, target string, port int32) dns.RR {
+	return &dns.SRV{Hdr: e.header(qname, dns.TypeSRV), Priority: 0, Weight: 100, Port: uint16(port), Target: target}
+}
+
+func (e *emergencyResolver) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     e.header(e.zone, dns.TypeSOA),
+		Ns:      "ns.dns." + e.zone,
+		Mbox:    "hostmaster." + e.zone,
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  e.ttl,
+	}
+}
+
+// serveEmergency writes the local answer when no upstream is healthy
+func (df *KubeForward) serveEmergency(w dns.ResponseWriter, state request.Request, zone string, m *dns.Msg) (int, error) {
+	if changed(&df.emergency.active, true) {
+		df.log[subsystemForwarder].Warningf("no healthy upstream, answering %s Services from the API", df.emergency.zone)
+	}
+	EmergencyRequests.WithLabelValues(zone, dns.RcodeToString[m.Rcode]).Inc()
+
+	w.WriteMsg(state.Scrub(m))
+	return 0, nil
+}
@@ -0,0 +1,181 @@
+package kubeforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestEmergencyResolver(t *testing.T) *emergencyResolver {
+	t.Helper()
+
+	e := newEmergencyResolver(&EmergencyConfig{Zone: "cluster.local.", TTL: 5}, nil)
+	e.synced.Store(true)
+
+	services := []*corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP:  "10.96.0.10",
+				ClusterIPs: []string{"10.96.0.10", "fd00::10"},
+				Ports:      []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "external"},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: "example.org"},
+		},
+	}
+	for _, svc := range services {
+		if err := e.services.Add(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hostname, notReady := "db-0", false
+	portName, protocol, port := "postgres", corev1.ProtocolTCP, int32(5432)
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db-abc", Labels: map[string]string{discoveryv1.LabelServiceName: "db"}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, Hostname: &hostname},
+			{Addresses: []string{"10.0.0.2"}},
+			{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: &portName, Protocol: &protocol, Port: &port}},
+	}
+	if err := e.slices.Add(slice); err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func TestEmergencyAnswer(t *testing.T) {
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		expectedRcode int
+		expected      []string
+	}{
+		{name: "ClusterIP A", qname: "web.default.svc.cluster.local.", qtype: dns.TypeA, expected: []string{"web.default.svc.cluster.local.\t5\tIN\tA\t10.96.0.10"}},
+		{name: "ClusterIP AAAA", qname: "web.default.svc.cluster.local.", qtype: dns.TypeAAAA, expected: []string{"web.default.svc.cluster.local.\t5\tIN\tAAAA\tfd00::10"}},
+		{name: "ClusterIP SRV", qname: "_http._tcp.web.default.svc.cluster.local.", qtype: dns.TypeSRV, expected: []string{"_http._tcp.web.default.svc.cluster.local.\t5\tIN\tSRV\t0 100 80 web.default.svc.cluster.local."}},
+		{name: "unknown port", qname: "_grpc._tcp.web.default.svc.cluster.local.", qtype: dns.TypeSRV, expectedRcode: dns.RcodeNameError},
+		{name: "headless A of ready endpoints", qname: "db.default.svc.cluster.local.", qtype: dns.TypeA, expected: []string{"db.default.svc.cluster.local.\t5\tIN\tA\t10.0.0.1", "db.default.svc.cluster.local.\t5\tIN\tA\t10.0.0.2"}},
+		{name: "headless endpoint by hostname", qname: "db-0.db.default.svc.cluster.local.", qtype: dns.TypeA, expected: []string{"db-0.db.default.svc.cluster.local.\t5\tIN\tA\t10.0.0.1"}},
+		{name: "headless endpoint by address", qname: "10-0-0-2.db.default.svc.cluster.local.", qtype: dns.TypeA, expected: []string{"10-0-0-2.db.default.svc.cluster.local.\t5\tIN\tA\t10.0.0.2"}},
+		{name: "headless endpoint without AAAA", qname: "db-0.db.default.svc.cluster.local.", qtype: dns.TypeAAAA},
+		{name: "not ready endpoint", qname: "10-0-0-3.db.default.svc.cluster.local.", qtype: dns.TypeA, expectedRcode: dns.RcodeNameError},
+		{name: "headless SRV", qname: "_postgres._tcp.db.default.svc.cluster.local.", qtype: dns.TypeSRV, expected: []string{
+			"_postgres._tcp.db.default.svc.cluster.local.\t5\tIN\tSRV\t0 100 5432 db-0.db.default.svc.cluster.local.",
+			"_postgres._tcp.db.default.svc.cluster.local.\t5\tIN\tSRV\t0 100 5432 10-0-0-2.db.default.svc.cluster.local.",
+		}},
+		{name: "ExternalName", qname: "external.default.svc.cluster.local.", qtype: dns.TypeA, expected: []string{"external.default.svc.cluster.local.\t5\tIN\tCNAME\texample.org."}},
+		{name: "unknown service", qname: "missing.default.svc.cluster.local.", qtype: dns.TypeA, expectedRcode: dns.RcodeNameError},
+		{name: "namespace", qname: "default.svc.cluster.local.", qtype: dns.TypeA},
+	}
+
+	e := newTestEmergencyResolver(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+
+			m, ok := e.answer(request.Request{W: &test.ResponseWriter{}, Req: req})
+			if !ok {
+				t.Fatalf("expected query to be answered")
+			}
+			if m.Rcode != tt.expectedRcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.expectedRcode], dns.RcodeToString[m.Rcode])
+			}
+			if len(m.Answer) != len(tt.expected) {
+				t.Fatalf("expected %d records, got %v", len(tt.expected), m.Answer)
+			}
+			for i, rr := range m.Answer {
+				if rr.String() != tt.expected[i] {
+					t.Errorf("expected record %q, got %q", tt.expected[i], rr.String())
+				}
+			}
+			if len(m.Answer) == 0 && len(m.Ns) != 1 {
+				t.Errorf("expected SOA in negative answer, got %v", m.Ns)
+			}
+		})
+	}
+}
+
+func TestEmergencyAnswerOutOfZone(t *testing.T) {
+	e := newTestEmergencyResolver(t)
+
+	for _, qname := range []string{"example.org.", "pod-1.default.pod.cluster.local."} {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		if _, ok := e.answer(request.Request{W: &test.ResponseWriter{}, Req: req}); ok {
+			t.Errorf("expected %s not to be answered", qname)
+		}
+	}
+
+	// Nothing is answered before the Services are listed
+	e.synced.Store(false)
+	req := new(dns.Msg)
+	req.SetQuestion("web.default.svc.cluster.local.", dns.TypeA)
+	if _, ok := e.answer(request.Request{W: &test.ResponseWriter{}, Req: req}); ok {
+		t.Errorf("expected no answer before sync")
+	}
+}
+
+func TestServeDNSEmergency(t *testing.T) {
+	tests := []struct {
+		name          string
+		upstream      *fakeUpstream
+		expectedRcode int
+		expectLocal   bool
+	}{
+		{name: "healthy upstream", upstream: &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeRefused}, expectedRcode: dns.RcodeRefused},
+		{name: "unhealthy upstream", upstream: &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeRefused, fails: maxFails}, expectedRcode: dns.RcodeSuccess, expectLocal: true},
+		{name: "failing upstream", upstream: &fakeUpstream{addr: "10.0.0.1:53", err: errors.New("timeout")}, expectedRcode: dns.RcodeSuccess, expectLocal: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kf := &KubeForward{
+				Next:      test.NextHandler(dns.RcodeSuccess, nil),
+				routes:    []*route{newTestRoute(".", tc.upstream)},
+				emergency: newTestEmergencyResolver(t),
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			req := new(dns.Msg)
+			req.SetQuestion("web.default.svc.cluster.local.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			if _, err := kf.ServeDNS(ctx, rec, req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Msg == nil {
+				t.Fatalf("expected reply, got none")
+			}
+			if rec.Msg.Rcode != tc.expectedRcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tc.expectedRcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+			if local := len(rec.Msg.Answer) == 1; local != tc.expectLocal {
+				t.Errorf("expected local answer %v, got %v", tc.expectLocal, rec.Msg.Answer)
+			}
+		})
+	}
+}
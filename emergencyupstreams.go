@@ -0,0 +1,82 @@
+package kubeforward
+
+import (
+	"sync/atomic"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/miekg/dns"
+)
+
+const defaultEmergencyResolvConf = "/etc/resolv.conf"
+
+// EmergencyUpstreamsConfig is the configuration of emergency_upstreams
+type EmergencyUpstreamsConfig struct {
+	// To are the addresses of the resolvers, taken from resolv.conf files or given directly
+	To []string
+	// ClusterZones are never forwarded to the resolvers
+	ClusterZones []string
+}
+
+// emergencyForwarder forwards queries for names outside the cluster zones to fixed resolvers,
+// e.g. the ones of the node, while no discovered upstream is healthy.
+type emergencyForwarder struct {
+	upstreams    *upstreamSet
+	clusterZones []string
+	// active is set while queries are forwarded to the resolvers, to log transitions once
+	active atomic.Bool
+}
+
+func newEmergencyForwarder(cfg *EmergencyUpstreamsConfig, config KubeForwardConfig) *emergencyForwarder {
+	endpoints := make([]upstreamEndpoint, 0, len(cfg.To))
+	for _, addr := range cfg.To {
+		endpoints = append(endpoints, upstreamEndpoint{Addr: addr})
+	}
+	upstreams, _ := newUpstreamSet(upstreamAddrs{UDP: endpoints, TCP: endpoints}, resolverConfig(config), nil)
+	return &emergencyForwarder{
+		upstreams:    upstreams,
+		clusterZones: cfg.ClusterZones,
+	}
+}
+
+// resolverConfig strips the options meant for cluster DNS from config, for resolvers outside
+// the cluster of emergency_upstreams and direct routes: they serve plain DNS, are probed only after failures like in the forward plugin
+// and keep no outlier, latency or slow start state.
+func resolverConfig(config KubeForwardConfig) KubeForwardConfig {
+	config.Transport = transport.DNS
+	config.TLSConfig = nil
+	config.TLSServerName = ""
+	config.HealthCheck = nil
+	config.OutlierDetection = nil
+	config.AdaptiveTimeout = nil
+	config.SlowStart = nil
+	config.opts.HCDomain = "."
+	config.opts.HCRecursionDesired = true
+	return config
+}
+
+// covers reports if the name may be forwarded to the resolvers
+func (e *emergencyForwarder) covers(name string) bool {
+	return plugin.Zones(e.clusterZones).Matches(name) == ""
+}
+
+func (e *emergencyForwarder) stop() {
+	for _, u := range e.upstreams.all() {
+		u.Stop()
+	}
+}
+
+// observeEmergencyForward logs when forwarding to the emergency resolvers starts and stops
+// and counts the queries answered by them.
+func (df *KubeForward) observeEmergencyForward(zone string, ret *dns.Msg, used bool) {
+	if !used {
+		if changed(&df.emergencyUpstreams.active, false) {
+			df.log[subsystemForwarder].Infof("upstreams answer again, queries are no longer forwarded to emergency upstreams")
+		}
+		return
+	}
+	if changed(&df.emergencyUpstreams.active, true) {
+		df.log[subsystemForwarder].Warningf("no healthy upstream, forwarding queries outside of %v to emergency upstreams", df.emergencyUpstreams.clusterZones)
+	}
+	EmergencyForwardedRequests.WithLabelValues(zone, dns.RcodeToString[ret.Rcode]).Inc()
+}
@@ -0,0 +1,90 @@
+package kubeforward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSEmergencyUpstreams(t *testing.T) {
+	tests := []struct {
+		name            string
+		qname           string
+		upstream        *fakeUpstream
+		undiscovered    bool
+		expectedRcode   int
+		expectEmergency bool
+	}{
+		{name: "healthy upstream", qname: "example.org.", upstream: &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeRefused}, expectedRcode: dns.RcodeRefused},
+		{name: "unhealthy upstream", qname: "example.org.", upstream: &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeRefused, fails: maxFails}, expectedRcode: dns.RcodeSuccess, expectEmergency: true},
+		{name: "undiscovered route", qname: "example.org.", undiscovered: true, expectedRcode: dns.RcodeSuccess, expectEmergency: true},
+		{name: "cluster name", qname: "web.default.svc.cluster.local.", upstream: &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeRefused, fails: maxFails}, expectedRcode: dns.RcodeRefused},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver := &endpointUpstream{upstream: &fakeUpstream{addr: "192.168.0.1:53", rcode: dns.RcodeSuccess}}
+			var rt *route
+			if tc.undiscovered {
+				// The API is down since start, no discovery ever happens
+				rt = newRoute(RouteConfig{Zones: []string{"."}})
+				rt.started = time.Now().Add(-discoveryGrace)
+			} else {
+				rt = newTestRoute(".", tc.upstream)
+			}
+			kf := &KubeForward{
+				Next:   test.NextHandler(dns.RcodeSuccess, nil),
+				routes: []*route{rt},
+				emergencyUpstreams: &emergencyForwarder{
+					upstreams:    &upstreamSet{udp: []*endpointUpstream{resolver}, tcp: []*endpointUpstream{resolver}},
+					clusterZones: []string{"cluster.local."},
+				},
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			if _, err := kf.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Msg == nil {
+				t.Fatalf("expected reply, got none")
+			}
+			if rec.Msg.Rcode != tc.expectedRcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tc.expectedRcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+			if active := kf.emergencyUpstreams.active.Load(); active != tc.expectEmergency {
+				t.Errorf("expected emergency forwarding %v, got %v", tc.expectEmergency, active)
+			}
+		})
+	}
+}
+
+func TestEmergencyForwarderPlainUpstreams(t *testing.T) {
+	config := KubeForwardConfig{
+		Transport:           transport.TLS,
+		HealthCheck:         &HealthCheckConfig{Interval: time.Second, Timeout: time.Second, QName: "kubernetes.default.svc.cluster.local.", QType: dns.TypeA, Rise: 1, Fall: 1},
+		AdaptiveTimeout:     &AdaptiveTimeoutConfig{Percentile: 99, Factor: 2, Min: 100 * time.Millisecond, Max: time.Second, Samples: 100},
+		UpstreamReadTimeout: time.Second,
+		opts:                proxy.Options{HCDomain: "cluster.local."},
+	}
+	e := newEmergencyForwarder(&EmergencyUpstreamsConfig{To: []string{"192.168.0.1:53"}}, config)
+	defer e.stop()
+
+	// Options of cluster DNS do not apply to the resolvers
+	for _, u := range e.upstreams.all() {
+		if d, ok := u.upstream.(*dnsUpstream); !ok || d.client.TLSConfig != nil {
+			t.Errorf("expected plain DNS upstream for %s, got %T", u.Addr(), u.upstream)
+		}
+		if u.health != nil || u.latency != nil {
+			t.Errorf("expected no health check and adaptive timeout for %s", u.Addr())
+		}
+	}
+}
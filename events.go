@@ -0,0 +1,197 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the recorded events
+const (
+	reasonNoUpstreams           = "NoUpstreams"
+	reasonUpstreamsAvailable    = "UpstreamsAvailable"
+	reasonAllUpstreamsUnhealthy = "AllUpstreamsUnhealthy"
+	reasonUpstreamsHealthy      = "UpstreamsHealthy"
+	reasonWatchFailed           = "WatchFailed"
+	reasonWatchRecovered        = "WatchRecovered"
+	reasonFallbackEntered       = "FallbackEntered"
+	reasonFallbackLeft          = "FallbackLeft"
+)
+
+// eventHealthInterval is how often routes are checked for all upstreams being unhealthy
+const eventHealthInterval = time.Second
+
+// eventRecorder records Kubernetes Events about the Pod or Node kubeforward runs on.
+// Events are only recorded on state changes, and the broadcaster drops and aggregates
+// repeated ones, so many nodes do not flood the API server.
+type eventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	object      *corev1.ObjectReference
+}
+
+// newEventRecorder creates recorder for the own Pod (POD_NAME and POD_NAMESPACE env)
+// or Node (NODE_NAME env), as set by the downward API.
+func newEventRecorder(kind string) (*eventRecorder, error) {
+	nodeName := os.Getenv("NODE_NAME")
+
+	var object *corev1.ObjectReference
+	switch kind {
+	case "pod":
+		name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+		if name == "" || namespace == "" {
+			return nil, fmt.Errorf("events pod requires POD_NAME and POD_NAMESPACE environment variables")
+		}
+		object = &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name}
+	case "node":
+		if nodeName == "" {
+			return nil, fmt.Errorf("events node requires NODE_NAME environment variable")
+		}
+		// Node is referenced by name as UID, as kubelet does
+		object = &corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: nodeName, UID: types.UID(nodeName)}
+	default:
+		return nil, fmt.Errorf("events: unknown object %s", kind)
+	}
+
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{
+		// At most 5 events per object at once, then one per 5 minutes
+		BurstSize: 5,
+		QPS:       1. / 300,
+	}))
+
+	return &eventRecorder{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "kubeforward", Host: nodeName}),
+		object:      object,
+	}, nil
+}
+
+// start sends recorded events to the API server
+func (e *eventRecorder) start() error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("failed to create in-cluster config for events: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client for events: %w", err)
+	}
+
+	e.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return nil
+}
+
+func (e *eventRecorder) stop() {
+	e.broadcaster.Shutdown()
+}
+
+// eventf logs the event and records it, when events are enabled
+func (rt *route) eventf(eventtype, reason, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if eventtype == corev1.EventTypeWarning {
+		rt.log.Warningf("%s: %s", reason, message)
+	} else {
+		rt.log.Infof("%s: %s", reason, message)
+	}
+
+	if rt.events == nil {
+		return
+	}
+	rt.events.recorder.Event(rt.events.object, eventtype, reason, message)
+}
+
+// changed sets the condition and reports if it was different
+func changed(condition *atomic.Bool, active bool) bool {
+	return condition.Load() != active && condition.CompareAndSwap(!active, active)
+}
+
+// setNoUpstreams records when the route lost or regained all its endpoints
+func (rt *route) setNoUpstreams(empty bool) {
+	if !changed(&rt.noUpstreams, empty) {
+		return
+	}
+	if empty {
+		rt.eventf(corev1.EventTypeWarning, reasonNoUpstreams, "No endpoints discovered for %s", rt.source())
+	} else {
+		rt.eventf(corev1.EventTypeNormal, reasonUpstreamsAvailable, "Endpoints discovered again for %s", rt.source())
+	}
+}
+
+// setWatchStatus records when the EndpointSlice watch of the route failed or recovered
+func (rt *route) setWatchStatus(err error) {
+	if !changed(&rt.watchFailed, err != nil) {
+		return
+	}
+	if err != nil {
+		rt.eventf(corev1.EventTypeWarning, reasonWatchFailed, "EndpointSlice watch for %s failed: %v", rt.source(), err)
+	} else {
+		rt.eventf(corev1.EventTypeNormal, reasonWatchRecovered, "EndpointSlice watch for %s recovered", rt.source())
+	}
+}
+
+// setFallback records when queries of the route started or stopped going to the next plugin
+// because no upstream answered
+func (rt *route) setFallback(active bool) {
+	if !changed(&rt.fallback, active) {
+		return
+	}
+	if active {
+		rt.eventf(corev1.EventTypeWarning, reasonFallbackEntered, "No upstream of %s answered, queries for %v go to the next plugin", rt.source(), rt.zones)
+	} else {
+		rt.eventf(corev1.EventTypeNormal, reasonFallbackLeft, "Upstreams of %s answer again", rt.source())
+	}
+}
+
+// checkHealth records when all upstreams of the route became unhealthy or one recovered
+func (rt *route) checkHealth() {
+	rt.mu.Lock()
+	upstreams := rt.upstreams
+	rt.mu.Unlock()
+
+	if upstreams == nil {
+		return
+	}
+
+	all := upstreams.all()
+	down := len(all) > 0
+	for _, u := range all {
+		if !u.Down(maxFails) {
+			down = false
+			break
+		}
+	}
+
+	if !changed(&rt.allDown, down) {
+		return
+	}
+	if down {
+		rt.eventf(corev1.EventTypeWarning, reasonAllUpstreamsUnhealthy, "All %d upstreams of %s are unhealthy", len(all), rt.source())
+	} else {
+		rt.eventf(corev1.EventTypeNormal, reasonUpstreamsHealthy, "Upstreams of %s are healthy again", rt.source())
+	}
+}
+
+// watchHealth runs checkHealth until ctx is done
+func (rt *route) watchHealth(ctx context.Context) {
+	ticker := time.NewTicker(eventHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rt.checkHealth()
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package kubeforward
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRouteEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		apply    func(rt *route)
+		expected []string
+	}{
+		{
+			name: "Watch failed and recovered once",
+			apply: func(rt *route) {
+				rt.setWatchStatus(errors.New("connection refused"))
+				rt.setWatchStatus(errors.New("connection refused"))
+				rt.setWatchStatus(nil)
+				rt.setWatchStatus(nil)
+			},
+			expected: []string{"Warning WatchFailed", "Normal WatchRecovered"},
+		},
+		{
+			name: "Endpoint set became empty",
+			apply: func(rt *route) {
+				rt.updateForwardServers(upstreamAddrs{}, testUpstreamConfig())
+				rt.updateForwardServers(upstreamAddrs{}, testUpstreamConfig())
+			},
+			expected: []string{"Warning NoUpstreams"},
+		},
+		{
+			name: "Fallback entered and left",
+			apply: func(rt *route) {
+				rt.setFallback(false)
+				rt.setFallback(true)
+				rt.setFallback(true)
+				rt.setFallback(false)
+			},
+			expected: []string{"Warning FallbackEntered", "Normal FallbackLeft"},
+		},
+		{
+			name: "All upstreams unhealthy",
+			apply: func(rt *route) {
+				rt.checkHealth()
+				rt.upstreams.udp[0].upstream.(*fakeUpstream).fails = maxFails
+				rt.checkHealth()
+				rt.checkHealth()
+				rt.upstreams.udp[0].upstream.(*fakeUpstream).fails = 0
+				rt.checkHealth()
+			},
+			expected: []string{"Warning AllUpstreamsUnhealthy", "Normal UpstreamsHealthy"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			rt := newTestRoute(".", &fakeUpstream{addr: "10.0.0.1:53"})
+			rt.events = &eventRecorder{recorder: recorder}
+
+			test.apply(rt)
+			close(recorder.Events)
+
+			var got []string
+			for event := range recorder.Events {
+				got = append(got, event)
+			}
+			if len(got) != len(test.expected) {
+				t.Fatalf("expected events %v, got %v", test.expected, got)
+			}
+			for i, event := range got {
+				if !strings.HasPrefix(event, test.expected[i]+" ") {
+					t.Errorf("expected event %q, got %q", test.expected[i], event)
+				}
+			}
+		})
+	}
+}
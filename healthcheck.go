@@ -0,0 +1,182 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// expectAny accepts any answer record of the queried type
+	expectAny         = "any"
+	defaultHealthRise = 2
+	defaultHealthFall = 3
+)
+
+// HealthCheckConfig configures the active health checks of health_check.
+type HealthCheckConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	QName    string
+	QType    uint16
+	// Expect is the content the answer must contain, e.g. 10.96.0.1 for A query; "any" accepts any record of QType
+	Expect []string
+	// Rise is the number of passed checks in a row marking upstream healthy
+	Rise int
+	// Fall is the number of failed checks in a row marking upstream unhealthy
+	Fall int
+}
+
+// checkExchanger is implemented by upstreams, it sends the query directly over the transport of the upstream
+type checkExchanger interface {
+	exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// activeHealth checks one upstream every interval and keeps its state. The upstream starts healthy.
+type activeHealth struct {
+	config           *HealthCheckConfig
+	recursionDesired bool
+	addr             string
+	exchange         func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	log              *logger
+
+	healthy   atomic.Bool
+	fails     atomic.Uint32
+	successes int
+	stop      chan struct{}
+}
+
+// startHealthCheck starts active health checks of the upstream, if its transport supports them.
+func (u *endpointUpstream) startHealthCheck(config KubeForwardConfig) {
+	exchanger, ok := u.upstream.(checkExchanger)
+	if !ok {
+		return
+	}
+
+	h := &activeHealth{
+		config:           config.HealthCheck,
+		recursionDesired: config.opts.HCRecursionDesired,
+		addr:             u.Addr(),
+		exchange:         exchanger.exchange,
+		log:              config.log[subsystemForwarder],
+		stop:             make(chan struct{}),
+	}
+	h.healthy.Store(true)
+	u.health = h
+
+	go h.run()
+}
+
+func (h *activeHealth) run() {
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.record(h.check())
+		}
+	}
+}
+
+// check sends the health check query and validates the reply
+func (h *activeHealth) check() error {
+	m := new(dns.Msg)
+	m.SetQuestion(h.config.QName, h.config.QType)
+	m.RecursionDesired = h.recursionDesired
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	ret, err := h.exchange(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	return validateReply(h.config, ret)
+}
+
+// record updates the state with the result of one check, applying rise and fall thresholds
+func (h *activeHealth) record(err error) {
+	if err == nil {
+		h.fails.Store(0)
+		h.successes++
+		if h.successes >= h.config.Rise && !h.healthy.Load() {
+			h.healthy.Store(true)
+			h.log.Infof("upstream %s is healthy after %d passed health checks", h.addr, h.successes)
+		}
+		return
+	}
+
+	h.successes = 0
+	fails := h.fails.Add(1)
+	h.log.Debugf("health check of upstream %s failed: %v", h.addr, err)
+	if int(fails) >= h.config.Fall && h.healthy.Load() {
+		h.healthy.Store(false)
+		h.log.Warningf("upstream %s is unhealthy after %d failed health checks: %v", h.addr, fails, err)
+	}
+}
+
+// validateReply checks the rcode and, with expect, the answer of the health check reply.
+func validateReply(config *HealthCheckConfig, ret *dns.Msg) error {
+	if len(config.Expect) == 0 {
+		if ret.Rcode != dns.RcodeSuccess && ret.Rcode != dns.RcodeNameError {
+			return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[ret.Rcode])
+		}
+		return nil
+	}
+
+	if ret.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[ret.Rcode])
+	}
+	for _, rr := range ret.Answer {
+		if rr.Header().Rrtype != config.QType {
+			continue
+		}
+		if config.Expect[0] == expectAny {
+			return nil
+		}
+		rdata := strings.TrimPrefix(rr.String(), rr.Header().String())
+		if slices.Contains(config.Expect, rdata) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("answer for %s %s does not contain %v", config.QName, dns.TypeToString[config.QType], config.Expect)
+}
+
+func (u *endpointUpstream) Down(maxfails uint32) bool {
+	if u.health != nil {
+		return !u.health.healthy.Load()
+	}
+	return u.upstream.Down(maxfails)
+}
+
+func (u *endpointUpstream) Fails() uint32 {
+	if u.health != nil {
+		return u.health.fails.Load()
+	}
+	return u.upstream.Fails()
+}
+
+// Healthcheck kicks off probes of the upstream after a failed query, active checks run on their own
+func (u *endpointUpstream) Healthcheck() {
+	if u.health != nil {
+		return
+	}
+	u.upstream.Healthcheck()
+}
+
+func (u *endpointUpstream) Stop() {
+	if u.health != nil {
+		close(u.health.stop)
+	}
+	u.upstream.Stop()
+}
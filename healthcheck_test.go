@@ -0,0 +1,128 @@
+package kubeforward
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/miekg/dns"
+)
+
+func TestValidateReply(t *testing.T) {
+	reply := func(rcode int, rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.Rcode = rcode
+		for _, s := range rrs {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		expect  []string
+		reply   *dns.Msg
+		healthy bool
+	}{
+		{name: "noerror without expect", reply: reply(dns.RcodeSuccess), healthy: true},
+		{name: "nxdomain without expect", reply: reply(dns.RcodeNameError), healthy: true},
+		{name: "servfail without expect", reply: reply(dns.RcodeServerFailure), healthy: false},
+		{name: "refused without expect", reply: reply(dns.RcodeRefused), healthy: false},
+		{name: "expected address", expect: []string{"10.96.0.1"}, reply: reply(dns.RcodeSuccess, "kubernetes.default.svc.cluster.local. 5 IN A 10.96.0.1"), healthy: true},
+		{name: "one of expected addresses", expect: []string{"10.96.0.2", "10.96.0.1"}, reply: reply(dns.RcodeSuccess, "kubernetes.default.svc.cluster.local. 5 IN A 10.96.0.1"), healthy: true},
+		{name: "unexpected address", expect: []string{"10.96.0.1"}, reply: reply(dns.RcodeSuccess, "kubernetes.default.svc.cluster.local. 5 IN A 10.96.0.9"), healthy: false},
+		{name: "expected address in other type", expect: []string{"10.96.0.1"}, reply: reply(dns.RcodeSuccess, "kubernetes.default.svc.cluster.local. 5 IN TXT 10.96.0.1"), healthy: false},
+		{name: "any answer", expect: []string{expectAny}, reply: reply(dns.RcodeSuccess, "kubernetes.default.svc.cluster.local. 5 IN A 10.96.0.9"), healthy: true},
+		{name: "any without answer", expect: []string{expectAny}, reply: reply(dns.RcodeSuccess), healthy: false},
+		{name: "nxdomain with expect", expect: []string{expectAny}, reply: reply(dns.RcodeNameError), healthy: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &HealthCheckConfig{QName: "kubernetes.default.svc.cluster.local.", QType: dns.TypeA, Expect: tt.expect}
+			err := validateReply(config, tt.reply)
+			if (err == nil) != tt.healthy {
+				t.Errorf("expected healthy %v, got error %v", tt.healthy, err)
+			}
+		})
+	}
+}
+
+func TestActiveHealthRiseFall(t *testing.T) {
+	h := &activeHealth{config: &HealthCheckConfig{Rise: 2, Fall: 3}, addr: "10.0.0.1:53"}
+	h.healthy.Store(true)
+	u := &endpointUpstream{upstream: &fakeUpstream{addr: "10.0.0.1:53"}, health: h}
+
+	failed := errors.New("timeout")
+	steps := []struct {
+		err   error
+		down  bool
+		fails uint32
+	}{
+		{err: failed, down: false, fails: 1},
+		{err: failed, down: false, fails: 2},
+		{err: nil, down: false, fails: 0},
+		{err: failed, down: false, fails: 1},
+		{err: failed, down: false, fails: 2},
+		{err: failed, down: true, fails: 3},
+		{err: nil, down: true, fails: 0},
+		{err: failed, down: true, fails: 1},
+		{err: nil, down: true, fails: 0},
+		{err: nil, down: false, fails: 0},
+	}
+
+	for i, step := range steps {
+		h.record(step.err)
+		if u.Down(maxFails) != step.down {
+			t.Errorf("step %d: expected down %v, got %v", i, step.down, u.Down(maxFails))
+		}
+		if u.Fails() != step.fails {
+			t.Errorf("step %d: expected fails %d, got %d", i, step.fails, u.Fails())
+		}
+	}
+}
+
+func TestDNSUpstreamHealthCheck(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answer(r))
+	})
+	defer s.Close()
+
+	tests := []struct {
+		expect  string
+		healthy bool
+	}{
+		{expect: "192.0.2.1", healthy: true},
+		{expect: "192.0.2.2", healthy: false},
+	}
+
+	for _, tt := range tests {
+		for _, tcp := range []bool{false, true} {
+			config := testUpstreamConfig()
+			config.Transport = "dns"
+			config.HealthCheck = &HealthCheckConfig{
+				Interval: time.Hour,
+				Timeout:  time.Second,
+				QName:    "kubernetes.default.svc.cluster.local.",
+				QType:    dns.TypeA,
+				Expect:   []string{tt.expect},
+				Rise:     1,
+				Fall:     1,
+			}
+
+			created, err := newUpstream(upstreamEndpoint{Addr: s.Addr}, config, tcp)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			u := &endpointUpstream{upstream: created}
+			u.startHealthCheck(config)
+
+			if err := u.health.check(); (err == nil) != tt.healthy {
+				t.Errorf("expect %s, tcp=%v: expected healthy %v, got error %v", tt.expect, tcp, tt.healthy, err)
+			}
+			u.Stop()
+		}
+	}
+}
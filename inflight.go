@@ -0,0 +1,110 @@
+package kubeforward
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Scopes of the limit a shed query hit
+const (
+	overloadGlobal   = "global"
+	overloadUpstream = "upstream"
+)
+
+const defaultQueueTimeout = 100 * time.Millisecond
+
+// errOverloaded means every upstream has max_inflight per_upstream queries in flight
+var errOverloaded = errors.New("all upstreams are at max_inflight")
+
+// MaxInflightConfig configures concurrency limits of max_inflight.
+type MaxInflightConfig struct {
+	// Global limits queries forwarded at once, 0 disables it
+	Global int
+	// PerUpstream limits queries in flight to one upstream, 0 disables it
+	PerUpstream int
+	// QueueSize is the number of queries waiting up to QueueTimeout for a global slot
+	QueueSize    int
+	QueueTimeout time.Duration
+	// Rcode answers shed queries, SERVFAIL or REFUSED
+	Rcode int
+}
+
+// inflightLimiter admits queries up to the global limit, queueing a few of them shortly.
+type inflightLimiter struct {
+	config *MaxInflightConfig
+	// slots holds a token for every admitted query, nil without global limit
+	slots  chan struct{}
+	queued atomic.Int64
+}
+
+func newInflightLimiter(config *MaxInflightConfig) *inflightLimiter {
+	l := &inflightLimiter{config: config}
+	if config.Global > 0 {
+		l.slots = make(chan struct{}, config.Global)
+	}
+	return l
+}
+
+// admit waits for a global slot while the queue has room, ok is false when the query is shed.
+// The returned release must be called when the query is done.
+func (l *inflightLimiter) admit(ctx context.Context) (release func(), ok bool) {
+	if l.slots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		InflightRequests.Inc()
+		return l.release, true
+	default:
+	}
+
+	if l.queued.Add(1) > int64(l.config.QueueSize) {
+		l.queued.Add(-1)
+		return nil, false
+	}
+	QueuedRequests.Inc()
+	defer func() {
+		l.queued.Add(-1)
+		QueuedRequests.Dec()
+	}()
+
+	timer := time.NewTimer(l.config.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		InflightRequests.Inc()
+		return l.release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+func (l *inflightLimiter) release() {
+	<-l.slots
+	InflightRequests.Dec()
+}
+
+// saturated reports if the upstream has max_inflight per_upstream queries in flight
+func (df *KubeForward) saturated(u *endpointUpstream) bool {
+	return df.inflight != nil && df.inflight.config.PerUpstream > 0 && u.inflight.Load() >= int64(df.inflight.config.PerUpstream)
+}
+
+// serveOverloaded answers the shed query with the max_inflight rcode
+func (df *KubeForward) serveOverloaded(w dns.ResponseWriter, state request.Request, zone, scope string) (int, error) {
+	OverloadedRequests.WithLabelValues(zone, scope).Inc()
+	df.log[subsystemForwarder].Debugf("shed %s %s from %s, max_inflight %s limit reached", state.Type(), state.Name(), state.IP(), scope)
+
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, df.inflight.config.Rcode)
+	w.WriteMsg(m)
+	return 0, nil
+}
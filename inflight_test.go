@@ -0,0 +1,100 @@
+package kubeforward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestInflightLimiterAdmit(t *testing.T) {
+	l := newInflightLimiter(&MaxInflightConfig{Global: 1, QueueSize: 1, QueueTimeout: time.Second})
+
+	release, ok := l.admit(context.Background())
+	if !ok {
+		t.Fatalf("expected first query admitted")
+	}
+
+	// The second query waits in the queue until the first one is done
+	admitted := make(chan bool)
+	go func() {
+		release, ok := l.admit(context.Background())
+		if ok {
+			release()
+		}
+		admitted <- ok
+	}()
+	for l.queued.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, the third query is shed at once
+	if _, ok := l.admit(context.Background()); ok {
+		t.Errorf("expected query shed with full queue")
+	}
+
+	release()
+	if !<-admitted {
+		t.Errorf("expected queued query admitted after release")
+	}
+}
+
+func TestInflightLimiterQueueTimeout(t *testing.T) {
+	l := newInflightLimiter(&MaxInflightConfig{Global: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond})
+
+	release, _ := l.admit(context.Background())
+	defer release()
+
+	start := time.Now()
+	if _, ok := l.admit(context.Background()); ok {
+		t.Fatalf("expected queued query shed after queue timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("expected query to wait for queue timeout, waited %v", elapsed)
+	}
+}
+
+func TestServeDNSUpstreamSaturated(t *testing.T) {
+	tests := []struct {
+		name          string
+		inflight      []int64
+		expectedRcode int
+	}{
+		{name: "one upstream free", inflight: []int64{2, 0}, expectedRcode: dns.RcodeSuccess},
+		{name: "all upstreams busy", inflight: []int64{2, 3}, expectedRcode: dns.RcodeRefused},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := newTestRoute(".",
+				&fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeSuccess},
+				&fakeUpstream{addr: "10.0.0.2:53", rcode: dns.RcodeSuccess},
+			)
+			for i, u := range rt.upstreams.udp {
+				u.inflight.Store(tc.inflight[i])
+			}
+			kf := &KubeForward{
+				Next:     test.NextHandler(dns.RcodeSuccess, nil),
+				routes:   []*route{rt},
+				inflight: newInflightLimiter(&MaxInflightConfig{PerUpstream: 2, Rcode: dns.RcodeRefused}),
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.org.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			if _, err := kf.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Msg == nil {
+				t.Fatalf("expected reply, got none")
+			}
+			if rec.Msg.Rcode != tc.expectedRcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tc.expectedRcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+		})
+	}
+}
@@ -2,134 +2,559 @@ package kubeforward
 
 import (
 	"context"
-	"log"
-	"sync"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
-	"github.com/coredns/coredns/plugin/forward"
-	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/dnstap"
 	"github.com/coredns/coredns/plugin/pkg/proxy"
 	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// defaultTimeout is the time limit for one query over all tried upstreams, as in forward
+const defaultTimeout = 5 * time.Second
+
+// errNoUpstreams means there are no discovered upstreams for the query transport
+var errNoUpstreams = errors.New("no upstreams discovered")
+
 // KubeForward main struct of plugin
 type KubeForward struct {
-	Next           plugin.Handler
-	Namespace      string
-	ServiceName    string
-	forwardTo      []string
-	forwarder      *forward.Forward
-	options        proxy.Options
-	cond           *sync.Cond
-	slowThreshold  time.Duration
-	slowLogEnabled bool
+	Next                   plugin.Handler
+	routes                 []*route
+	except                 []string
+	fallthroughRcodes      []int
+	fallthroughNoUpstreams bool
+	clientIdentity         *clientIdentity
+	chaosACL               []netip.Prefix
+	transport              string
+	options                proxy.Options
+	slowThreshold          time.Duration
+	slowLogEnabled         bool
+	tracer                 trace.Tracer
+	tapPlugins             []*dnstap.Dnstap
+	rateLimiter            *rateLimiter
+	inflight               *inflightLimiter
+	coalescer              *coalescer
+	emergency              *emergencyResolver
+	emergencyUpstreams     *emergencyForwarder
+	retry                  *retryPolicy
+	log                    loggers
+}
+
+// upstreamSet holds upstreams used for UDP and TCP queries. Upstreams with stream
+// transports (TLS, DoH, DoQ) serve both and are shared by the lists.
+type upstreamSet struct {
+	udp []*endpointUpstream
+	tcp []*endpointUpstream
+}
+
+// endpointUpstream is an upstream with the endpoint it was created for and its live stats.
+type endpointUpstream struct {
+	upstream
+	endpoint upstreamEndpoint
+	inflight atomic.Int64
+	lastRTT  atomic.Int64
+	// health is set when active health checks are configured, it replaces the health of the upstream
+	health *activeHealth
+	// outlier is set when outlier detection is configured
+	outlier      *outlierDetector
+	outlierStats outlierStats
+	// latency is set with adaptive read timeouts
+	latency *latencyWindow
+	// slowStart is set while a new endpoint ramps up with slow_start
+	slowStart *slowStart
+}
+
+// exchange sends the query to the upstream tracking in-flight queries and RTT
+func (u *endpointUpstream) exchange(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	u.inflight.Add(1)
+	defer u.inflight.Add(-1)
+
+	queryCtx := ctx
+	if u.latency != nil {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, u.latency.timeout())
+		defer cancel()
+	}
+
+	start := time.Now()
+	ret, err := u.Exchange(queryCtx, state, opts)
+	rtt := time.Since(start)
+	// Queries abandoned at the adaptive timeout are not recorded, taking the timeout as their RTT
+	// would raise it with every loss and keep a stalled upstream from being abandoned quickly
+	if err == nil {
+		u.lastRTT.Store(int64(rtt))
+		if u.latency != nil {
+			u.latency.record(rtt)
+		}
+	}
+
+	return ret, err
 }
 
 func (df *KubeForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	df.cond.L.Lock()
-	if df.forwarder == nil {
-		df.cond.Wait()
+	state := request.Request{W: w, Req: r}
+
+	if df.isChaos(state) {
+		return df.serveChaos(w, state)
+	}
+
+	if plugin.Zones(df.except).Matches(state.Name()) != "" {
+		return plugin.NextOrFailure(df.Name(), df.Next, ctx, w, r)
+	}
+
+	rt, zone := matchRoute(df.routes, state.Name())
+	if rt == nil {
+		return plugin.NextOrFailure(df.Name(), df.Next, ctx, w, r)
+	}
+
+	if df.rateLimiter != nil {
+		if ok, scope := df.rateLimiter.allow(state.IP()); !ok {
+			return df.serveLimited(w, state, zone, scope)
+		}
+	}
+
+	if df.inflight != nil {
+		release, ok := df.inflight.admit(ctx)
+		if !ok {
+			return df.serveOverloaded(w, state, zone, overloadGlobal)
+		}
+		defer release()
 	}
-	forwarder := df.forwarder
-	df.cond.L.Unlock()
 
-	rec := &responseRecorder{ResponseWriter: w}
+	upstreams := rt.currentUpstreams(ctx)
+
+	if df.emergency != nil && !upstreams.healthy() {
+		if m, ok := df.emergency.answer(state); ok {
+			return df.serveEmergency(w, state, zone, m)
+		}
+	}
+
+	// Names outside the cluster are resolved by the emergency upstreams while none of the route is healthy
+	emergencyForward := false
+	if df.emergencyUpstreams != nil && !upstreams.healthy() && df.emergencyUpstreams.covers(state.Name()) {
+		upstreams = df.emergencyUpstreams.upstreams
+		emergencyForward = true
+	}
+
+	upstreamState := state
+	stripIdentity := func(*dns.Msg) {}
+	// Client identity is meant for cluster DNS, resolvers outside the cluster never see it
+	if df.clientIdentity != nil && !emergencyForward && !rt.direct {
+		upstreamState.Req, stripIdentity = df.clientIdentity.attach(state)
+	}
+
+	ctx, span := df.startSpan(ctx, state, zone)
+	defer span.finish()
+
 	start := time.Now()
-	rcode, err := forwarder.ServeDNS(ctx, rec, r)
+	var (
+		ret    *dns.Msg
+		result forwardResult
+		err    error
+	)
+	if df.coalescer != nil {
+		var coalesced bool
+		// The reply is shared by the waiters, so the query is not canceled with the client of the first one
+		forwardCtx := context.WithoutCancel(ctx)
+		ret, result, coalesced, err = df.coalescer.do(ctx, df.coalesceKey(state), r, func() (*dns.Msg, forwardResult, error) {
+			return df.forward(forwardCtx, upstreamState, upstreams)
+		})
+		if coalesced {
+			span.setTag("kubeforward.coalesced", true)
+			CoalescedRequests.WithLabelValues(zone).Inc()
+		}
+	} else {
+		ret, result, err = df.forward(ctx, upstreamState, upstreams)
+	}
 	elapsed := time.Since(start)
-	rcodeStr := dns.RcodeToString[rec.recordedRcode(rcode)]
+	setResult(span, result)
+	setMetadata(ctx, result, elapsed)
+
+	upstreamAddr := ""
+	if result.upstream != nil {
+		upstreamAddr = result.upstream.Addr()
+	}
+
+	if errors.Is(err, errOverloaded) {
+		span.setError(err)
+		return df.serveOverloaded(w, state, zone, overloadUpstream)
+	}
+	if err != nil {
+		span.setError(err)
+		if df.emergency != nil {
+			if m, ok := df.emergency.answer(state); ok {
+				return df.serveEmergency(w, state, zone, m)
+			}
+		}
+		df.observeRequest(span, r, zone, dns.RcodeToString[dns.RcodeServerFailure], upstreamAddr, elapsed)
+		if df.fallthroughNoUpstreams && df.Next != nil {
+			FallthroughRequests.WithLabelValues(zone, "no_upstreams").Inc()
+			rt.setFallback(true)
+			return plugin.NextOrFailure(df.Name(), df.Next, ctx, w, r)
+		}
+		return dns.RcodeServerFailure, err
+	}
+
+	if df.emergencyUpstreams != nil {
+		df.observeEmergencyForward(zone, ret, emergencyForward)
+	}
+	if !emergencyForward {
+		rt.setFallback(false)
+		if df.emergency != nil && changed(&df.emergency.active, false) {
+			df.log[subsystemForwarder].Infof("upstreams answer again, %s Services are no longer answered from the API", df.emergency.zone)
+		}
+	}
+	stripIdentity(ret)
+
+	// Check if the reply is correct; if not return FormErr.
+	if !state.Match(ret) {
+		formerr := new(dns.Msg)
+		formerr.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(formerr)
+		df.observeRequest(span, r, zone, dns.RcodeToString[dns.RcodeFormatError], upstreamAddr, elapsed)
+		return 0, nil
+	}
 
-	df.observeRequest(ctx, r, rcodeStr, elapsed)
+	df.observeRequest(span, r, zone, dns.RcodeToString[ret.Rcode], upstreamAddr, elapsed)
 
-	return rcode, err
+	// Let the next plugin answer instead of returning the failure to the client
+	if slices.Contains(df.fallthroughRcodes, ret.Rcode) && df.Next != nil {
+		FallthroughRequests.WithLabelValues(zone, dns.RcodeToString[ret.Rcode]).Inc()
+		return plugin.NextOrFailure(df.Name(), df.Next, ctx, w, r)
+	}
+
+	w.WriteMsg(ret)
+
+	return 0, nil
 }
 
-func (df *KubeForward) observeRequest(ctx context.Context, r *dns.Msg, rcodeStr string, elapsed time.Duration) {
+// forwardResult describes how the query was forwarded
+type forwardResult struct {
+	// upstream tried last
+	upstream *endpointUpstream
+	// number of queries sent to upstreams
+	attempts int
+}
+
+// forward sends the query to the UDP or TCP upstream set, depending on the client
+// transport and the force_tcp/prefer_udp options.
+func (df *KubeForward) forward(ctx context.Context, state request.Request, upstreams *upstreamSet) (*dns.Msg, forwardResult, error) {
+	opts := df.options
+	if df.retry != nil {
+		df.retry.request()
+	}
+
+	if opts.ForceTCP || (state.Proto() == "tcp" && !opts.PreferUDP) {
+		opts.ForceTCP = true
+		return df.exchange(ctx, state, upstreams.tcp, opts)
+	}
+
+	ret, result, err := df.exchange(ctx, state, upstreams.udp, opts)
+	if err == nil && ret.Truncated && opts.PreferUDP {
+		// Retry truncated reply over TCP against the TCP upstream set
+		opts.ForceTCP = true
+		attempts := result.attempts
+		ret, result, err = df.exchange(ctx, state, upstreams.tcp, opts)
+		result.attempts += attempts
+	}
+
+	return ret, result, err
+}
+
+// exchange tries upstreams in random order until one answers, skipping the ones that are down,
+// the same way forward does.
+func (df *KubeForward) exchange(ctx context.Context, state request.Request, upstreams []*endpointUpstream, opts proxy.Options) (*dns.Msg, forwardResult, error) {
+	var result forwardResult
+	if len(upstreams) == 0 {
+		return nil, result, errNoUpstreams
+	}
+
+	list := make([]*endpointUpstream, len(upstreams))
+	copy(list, upstreams)
+	shuffleUpstreams(list)
+
+	var (
+		upstreamErr error
+		// lastReply is the last reply that was retried
+		lastReply *dns.Msg
+		// pending is the reason of the retry sent with the next query, retries are the ones sent
+		pending string
+		retries int
+	)
+	fails, saturated := 0, 0
+	i := 0
+	deadline := time.Now().Add(defaultTimeout)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		if i >= len(list) && df.retry != nil && result.attempts > 0 {
+			// Retries go to a different upstream only
+			break
+		}
+		if i >= len(list) {
+			// reached the end of list, reset to begin
+			i = 0
+			fails, saturated = 0, 0
+		}
+
+		u := list[i]
+		i++
+		busy := df.saturated(u)
+		if busy || u.Down(maxFails) || u.ejected() {
+			fails++
+			if busy {
+				saturated++
+			}
+			if fails < len(list) {
+				continue
+			}
+			if saturated > 0 {
+				// Shed the query rather than pile up on busy upstreams
+				return nil, result, errOverloaded
+			}
+			// All upstreams are down or ejected, assume healthcheck is broken and pick a random one
+			u = list[rand.IntN(len(list))]
+		}
+
+		if pending != "" {
+			if !df.retry.retry(pending, retries+1) {
+				break
+			}
+			retries++
+			pending = ""
+		}
+
+		result.upstream = u
+		result.attempts++
+		start := time.Now()
+		tryCtx, cancel := ctx, context.CancelFunc(func() {})
+		if df.retry != nil {
+			tryCtx, cancel = df.retry.tryContext(ctx)
+		}
+		ret, err := u.exchange(tryCtx, state, opts)
+		cancel()
+		u.recordOutcome(ret, err)
+		if len(df.tapPlugins) != 0 {
+			df.toDnstap(ctx, u.Addr(), state, opts, ret, start)
+		}
+		if err != nil {
+			df.log[subsystemForwarder].Debugf("upstream %s failed for %s %s: %v", u.Addr(), state.Type(), state.Name(), err)
+			upstreamErr = err
+			// Kick off health check to see if *our* upstream is broken.
+			u.Healthcheck()
+		}
+
+		if err != nil {
+			// Network errors fail over like without retry, timeouts are retries with attempts and budget
+			if df.retry != nil && isTimeout(err) {
+				if !df.retry.config.Timeout {
+					break
+				}
+				pending = retryTimeout
+			}
+			continue
+		}
+		if df.retry != nil {
+			reason := df.retry.reason(ret)
+			if reason == "" {
+				return ret, result, nil
+			}
+			lastReply, pending = ret, reason
+			continue
+		}
+
+		return ret, result, nil
+	}
+
+	if lastReply != nil {
+		// Out of upstreams to retry, the client gets the last failure
+		return lastReply, result, nil
+	}
+	if upstreamErr == nil {
+		upstreamErr = ctx.Err()
+	}
+
+	return nil, result, upstreamErr
+}
+
+// observeRequest records metrics of the query, with the trace ID of the span as exemplar
+func (df *KubeForward) observeRequest(span querySpan, r *dns.Msg, zone string, rcodeStr string, upstreamAddr string, elapsed time.Duration) {
+	span.setTag("dns.rcode", rcodeStr)
 	if len(r.Question) == 0 {
 		return
 	}
 
 	q := r.Question[0]
 	qtype := dns.TypeToString[q.Qtype]
+	labels := exemplar(span.traceID())
 
-	RequestDuration.WithLabelValues(qtype, rcodeStr).Observe(elapsed.Seconds())
+	duration := RequestDuration.WithLabelValues(zone, qtype, rcodeStr)
+	if observer, ok := duration.(prometheus.ExemplarObserver); ok && labels != nil {
+		observer.ObserveWithExemplar(elapsed.Seconds(), labels)
+	} else {
+		duration.Observe(elapsed.Seconds())
+	}
 
 	if df.slowThreshold > 0 && elapsed > df.slowThreshold {
-		upstream := upstreamFromContext(ctx)
-		SlowRequests.WithLabelValues(qtype, rcodeStr, upstream).Inc()
+		upstream := upstreamAddr
+		if upstream == "" {
+			upstream = "unknown"
+		}
+		slow := SlowRequests.WithLabelValues(zone, qtype, rcodeStr, upstream)
+		if adder, ok := slow.(prometheus.ExemplarAdder); ok && labels != nil {
+			adder.AddWithExemplar(1, labels)
+		} else {
+			slow.Inc()
+		}
 		if df.slowLogEnabled {
-			log.Printf("[kubeforward] slow query %s %s took %v (rcode=%s, upstream=%s)",
+			df.log[subsystemSlow].Infof("slow query %s %s took %v (rcode=%s, upstream=%s)",
 				qtype, q.Name, elapsed, rcodeStr, upstream)
 		}
 	}
 }
 
-// need `metadata` plugin before kubeforward in chain
-func upstreamFromContext(ctx context.Context) string {
-	if upstreamFunc := metadata.ValueFunc(ctx, "forward/upstream"); upstreamFunc != nil {
-		if upstream := upstreamFunc(); upstream != "" {
-			return upstream
+// newUpstreamSet creates and starts upstreams for the discovered endpoints. Upstreams of the
+// current set for unchanged endpoints are reused with their health, outlier and latency state,
+// the returned ones are not used anymore and are left to stop to the caller.
+func newUpstreamSet(servers upstreamAddrs, config KubeForwardConfig, current *upstreamSet) (*upstreamSet, []*endpointUpstream) {
+	// Plain DNS upstreams are created per protocol, others are shared by address
+	shared := make(map[string]*endpointUpstream)
+	key := func(server upstreamEndpoint, tcp bool) string {
+		if endpointTransport(server.AppProtocol, config.Transport) != transport.DNS {
+			return server.Addr
+		}
+		if tcp {
+			return "tcp/" + server.Addr
 		}
+		return "udp/" + server.Addr
 	}
 
-	return "unknown"
-}
+	existing := make(map[string]*endpointUpstream)
+	if current != nil {
+		for _, u := range current.udp {
+			existing[key(u.endpoint, false)] = u
+		}
+		for _, u := range current.tcp {
+			existing[key(u.endpoint, true)] = u
+		}
+	}
+	reused := make(map[*endpointUpstream]struct{})
 
-type responseRecorder struct {
-	dns.ResponseWriter
-	rcode int
-}
+	build := func(endpoints []upstreamEndpoint, tcp bool) []*endpointUpstream {
+		list := make([]*endpointUpstream, 0, len(endpoints))
+		for _, server := range endpoints {
+			plain := endpointTransport(server.AppProtocol, config.Transport) == transport.DNS
+			if u, ok := shared[server.Addr]; ok && !plain {
+				list = append(list, u)
+				continue
+			}
+			if u, ok := existing[key(server, tcp)]; ok && u.endpoint == server {
+				reused[u] = struct{}{}
+				if !plain {
+					shared[server.Addr] = u
+				}
+				list = append(list, u)
+				continue
+			}
 
-func (r *responseRecorder) WriteMsg(res *dns.Msg) error {
-	r.rcode = res.Rcode
-	return r.ResponseWriter.WriteMsg(res)
-}
+			created, err := newUpstream(server, config, tcp)
+			if err != nil {
+				config.log[subsystemForwarder].Warningf("skipping upstream %s: %v", server.Addr, err)
+				continue
+			}
+			created.Start(hcInterval)
+			u := &endpointUpstream{upstream: created, endpoint: server}
+			if config.HealthCheck != nil {
+				u.startHealthCheck(config)
+			}
+			if config.AdaptiveTimeout != nil {
+				u.latency = newLatencyWindow(config.AdaptiveTimeout)
+			}
+			if !plain {
+				shared[server.Addr] = u
+			}
+			list = append(list, u)
+		}
+		return list
+	}
 
-func (r *responseRecorder) recordedRcode(defaultRcode int) int {
-	if r.rcode != 0 {
-		return r.rcode
+	set := &upstreamSet{
+		udp: build(servers.UDP, false),
+		tcp: build(servers.TCP, true),
+	}
+	var removed []*endpointUpstream
+	if current != nil {
+		for _, u := range current.all() {
+			if _, ok := reused[u]; !ok {
+				removed = append(removed, u)
+			}
+		}
 	}
-	return defaultRcode
-}
 
-// UpdateForwardServers update list servers for forward requests
-func (df *KubeForward) UpdateForwardServers(newServers []string, config KubeForwardConfig) {
-	df.cond.L.Lock()
+	return set, removed
+}
 
-	newForwarder := forward.New()
+// healthy reports if any upstream of the set is neither down nor ejected
+func (s *upstreamSet) healthy() bool {
+	for _, u := range s.all() {
+		if !u.Down(maxFails) && !u.ejected() {
+			return true
+		}
+	}
+	return false
+}
 
-	for _, server := range newServers {
-		proxyInstance := proxy.NewProxy(server, server, transport.DNS)
-		proxyInstance.SetExpire(config.Expire)
-		proxyInstance.SetReadTimeout(config.UpstreamReadTimeout)
-		// forward.SetProxyOptions stores opts on the forwarder, but does not
-		// propagate healthcheck settings to already created proxies.
-		proxyInstance.GetHealthchecker().SetDomain(config.opts.HCDomain)
-		proxyInstance.GetHealthchecker().SetRecursionDesired(config.opts.HCRecursionDesired)
-		if config.opts.ForceTCP {
-			proxyInstance.GetHealthchecker().SetTCPTransport()
+// all returns every upstream of the set once
+func (s *upstreamSet) all() []*endpointUpstream {
+	seen := make(map[*endpointUpstream]struct{})
+	list := make([]*endpointUpstream, 0, len(s.udp)+len(s.tcp))
+	for _, u := range append(s.udp[:len(s.udp):len(s.udp)], s.tcp...) {
+		if _, ok := seen[u]; ok {
+			continue
 		}
-		newForwarder.SetProxy(proxyInstance)
-		newForwarder.SetProxyOptions(df.options)
+		seen[u] = struct{}{}
+		list = append(list, u)
 	}
 
-	oldForwarder := df.forwarder
+	return list
+}
 
-	// Fill up list servers
-	df.forwarder = newForwarder
-	df.forwardTo = newServers
-	df.cond.Broadcast()
-	df.cond.L.Unlock()
+// endpointTLSConfig returns TLS config for the endpoint, resolving {hostname} and {pod}
+// placeholders of tls_servername from the EndpointSlice data.
+func endpointTLSConfig(config KubeForwardConfig, server upstreamEndpoint) (*tls.Config, error) {
+	if config.TLSConfig == nil {
+		// Transport is inferred from appProtocol without tls directive, use system CA
+		config.TLSConfig = &tls.Config{ServerName: config.TLSServerName}
+	}
+	if !strings.Contains(config.TLSServerName, "{") {
+		return config.TLSConfig, nil
+	}
 
-	if oldForwarder != nil {
-		for _, oldProxy := range oldForwarder.List() {
-			oldProxy.Stop()
-		}
+	hostname := server.Hostname
+	if hostname == "" {
+		hostname = server.Pod
 	}
+	if strings.Contains(config.TLSServerName, "{hostname}") && hostname == "" {
+		return nil, fmt.Errorf("endpoint has neither hostname nor pod for tls_servername %s", config.TLSServerName)
+	}
+	if strings.Contains(config.TLSServerName, "{pod}") && server.Pod == "" {
+		return nil, fmt.Errorf("endpoint has no pod for tls_servername %s", config.TLSServerName)
+	}
+
+	tlsConfig := config.TLSConfig.Clone()
+	tlsConfig.ServerName = strings.NewReplacer("{hostname}", hostname, "{pod}", server.Pod).Replace(config.TLSServerName)
 
-	log.Printf("[kubeforward] Forward servers updated: %v", newServers)
+	return tlsConfig, nil
 }
 
 // Name return plugin name
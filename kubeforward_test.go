@@ -0,0 +1,359 @@
+package kubeforward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeUpstream answers every query with rcode, or fails with err
+type fakeUpstream struct {
+	addr  string
+	rcode int
+	err   error
+	fails uint32
+}
+
+func (u *fakeUpstream) Addr() string { return u.addr }
+
+func (u *fakeUpstream) Exchange(_ context.Context, state request.Request, _ proxy.Options) (*dns.Msg, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	ret := new(dns.Msg)
+	ret.SetRcode(state.Req, u.rcode)
+	return ret, nil
+}
+
+func (u *fakeUpstream) Healthcheck()              {}
+func (u *fakeUpstream) Down(maxfails uint32) bool { return u.fails >= maxfails }
+func (u *fakeUpstream) Fails() uint32             { return u.fails }
+func (u *fakeUpstream) Start(time.Duration)       {}
+func (u *fakeUpstream) Stop()                     {}
+
+// newTestRoute returns route for zone with already discovered upstreams
+func newTestRoute(zone string, upstreams ...upstream) *route {
+	list := make([]*endpointUpstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		list = append(list, &endpointUpstream{upstream: u, endpoint: upstreamEndpoint{Addr: u.Addr()}})
+	}
+
+	discovered := make(chan struct{})
+	close(discovered)
+	return &route{
+		zones:      []string{zone},
+		upstreams:  &upstreamSet{udp: list, tcp: list},
+		discovered: discovered,
+		slices:     cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+}
+
+func TestEndpointTLSConfig(t *testing.T) {
+	tests := []struct {
+		name               string
+		serverName         string
+		endpoint           upstreamEndpoint
+		expectedServerName string
+		expectErr          bool
+	}{
+		{
+			name:               "Static server name",
+			serverName:         "dns.example.org",
+			endpoint:           upstreamEndpoint{Addr: "10.0.0.1:853"},
+			expectedServerName: "dns.example.org",
+		},
+		{
+			name:               "Hostname placeholder",
+			serverName:         "{hostname}.dns.example.org",
+			endpoint:           upstreamEndpoint{Addr: "10.0.0.1:853", Hostname: "coredns-0", Pod: "coredns-abc"},
+			expectedServerName: "coredns-0.dns.example.org",
+		},
+		{
+			name:               "Hostname placeholder falls back to pod",
+			serverName:         "{hostname}.dns.example.org",
+			endpoint:           upstreamEndpoint{Addr: "10.0.0.1:853", Pod: "coredns-abc"},
+			expectedServerName: "coredns-abc.dns.example.org",
+		},
+		{
+			name:       "Pod placeholder without pod",
+			serverName: "{pod}.dns.example.org",
+			endpoint:   upstreamEndpoint{Addr: "10.0.0.1:853", Hostname: "coredns-0"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := KubeForwardConfig{
+				Transport:     "tls",
+				TLSConfig:     &tls.Config{ServerName: test.serverName},
+				TLSServerName: test.serverName,
+			}
+
+			tlsConfig, err := endpointTLSConfig(config, test.endpoint)
+
+			if test.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tlsConfig.ServerName != test.expectedServerName {
+				t.Errorf("expected server name %q, got %q", test.expectedServerName, tlsConfig.ServerName)
+			}
+		})
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	routes := []*route{
+		{zones: []string{"cluster.local.", "10.in-addr.arpa."}, serviceName: "coredns"},
+		{zones: []string{"corp.example."}, serviceName: "corp-resolver"},
+		{zones: []string{"."}, serviceName: "egress-resolver"},
+	}
+
+	tests := []struct {
+		qname           string
+		expectedService string
+		expectedZone    string
+	}{
+		{qname: "kubernetes.default.svc.cluster.local.", expectedService: "coredns", expectedZone: "cluster.local."},
+		{qname: "1.0.0.10.in-addr.arpa.", expectedService: "coredns", expectedZone: "10.in-addr.arpa."},
+		{qname: "intranet.corp.example.", expectedService: "corp-resolver", expectedZone: "corp.example."},
+		{qname: "example.org.", expectedService: "egress-resolver", expectedZone: "."},
+	}
+
+	for _, test := range tests {
+		rt, zone := matchRoute(routes, test.qname)
+		if rt == nil {
+			t.Fatalf("expected route for %s, got nil", test.qname)
+		}
+		if rt.serviceName != test.expectedService || zone != test.expectedZone {
+			t.Errorf("expected %s via zone %s for %s, got %s via zone %s", test.expectedService, test.expectedZone, test.qname, rt.serviceName, zone)
+		}
+	}
+
+	if rt, _ := matchRoute(routes[:2], "example.org."); rt != nil {
+		t.Errorf("expected no route for example.org., got %s", rt.serviceName)
+	}
+}
+
+func TestDirectRoute(t *testing.T) {
+	rt := newRoute(RouteConfig{Zones: []string{"."}, Direct: true, To: []string{"10.0.0.1:53"}})
+	if !rt.isStatic() {
+		t.Fatalf("expected route with static upstreams")
+	}
+
+	// Transport and health checks of cluster DNS do not apply to direct routes
+	config := KubeForwardConfig{
+		Transport:   transport.TLS,
+		HealthCheck: &HealthCheckConfig{Interval: time.Second, Timeout: time.Second, QName: "kubernetes.default.svc.cluster.local.", QType: dns.TypeA, Rise: 1, Fall: 1},
+		opts:        proxy.Options{HCDomain: "cluster.local."},
+	}
+	rt.updateForwardServers(rt.static, config)
+	defer func() {
+		for _, u := range rt.currentUpstreams(context.Background()).all() {
+			u.Stop()
+		}
+	}()
+
+	upstreams := rt.debugUpstreams(config.Transport)
+	if len(upstreams) != 2 {
+		t.Fatalf("expected UDP and TCP upstream, got %+v", upstreams)
+	}
+	for _, u := range upstreams {
+		if u.Address != "10.0.0.1:53" || u.Transport != transport.DNS {
+			t.Errorf("expected plain DNS upstream 10.0.0.1:53, got %s %s", u.Transport, u.Address)
+		}
+	}
+	for _, u := range rt.currentUpstreams(context.Background()).all() {
+		if u.health != nil {
+			t.Errorf("expected no active health check of %s", u.Addr())
+		}
+	}
+	if source := rt.source(); source != "upstreams [10.0.0.1:53]" {
+		t.Errorf("unexpected source %q", source)
+	}
+}
+
+func TestServeDNSFallthrough(t *testing.T) {
+	tests := []struct {
+		name            string
+		qname           string
+		upstream        *fakeUpstream
+		expectNext      bool
+		expectedRcode   int
+		fallthroughNoUp bool
+	}{
+		{
+			name:          "Answer from upstream",
+			qname:         "example.org.",
+			upstream:      &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeSuccess},
+			expectedRcode: dns.RcodeSuccess,
+		},
+		{
+			name:       "Excepted zone goes to next plugin",
+			qname:      "host.corp.example.",
+			upstream:   &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeSuccess},
+			expectNext: true,
+		},
+		{
+			name:       "Fallthrough on rcode",
+			qname:      "example.org.",
+			upstream:   &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeRefused},
+			expectNext: true,
+		},
+		{
+			name:          "Rcode without fallthrough",
+			qname:         "example.org.",
+			upstream:      &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeNameError},
+			expectedRcode: dns.RcodeNameError,
+		},
+		{
+			name:            "Fallthrough when no upstream answered",
+			qname:           "example.org.",
+			upstream:        &fakeUpstream{addr: "10.0.0.1:53", err: errors.New("timeout")},
+			fallthroughNoUp: true,
+			expectNext:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kf := &KubeForward{
+				Next:                   test.NextHandler(dns.RcodeSuccess, nil),
+				routes:                 []*route{newTestRoute(".", tc.upstream)},
+				except:                 []string{"corp.example."},
+				fallthroughRcodes:      []int{dns.RcodeRefused},
+				fallthroughNoUpstreams: tc.fallthroughNoUp,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			_, err := kf.ServeDNS(ctx, rec, req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// NextHandler does not write a reply
+			if tc.expectNext {
+				if rec.Msg != nil {
+					t.Errorf("expected query to be passed to next plugin, got reply %v", rec.Msg)
+				}
+				return
+			}
+			if rec.Msg == nil {
+				t.Fatalf("expected reply, got none")
+			}
+			if rec.Msg.Rcode != tc.expectedRcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tc.expectedRcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+		})
+	}
+}
+
+func TestServeDNSUndiscoveredRoute(t *testing.T) {
+	kf := &KubeForward{
+		Next:                   test.NextHandler(dns.RcodeSuccess, nil),
+		routes:                 []*route{newRoute(RouteConfig{Zones: []string{"."}})},
+		fallthroughNoUpstreams: true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	// The query does not wait for a discovery that never comes
+	start := time.Now()
+	if _, err := kf.ServeDNS(ctx, rec, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected query to fall through by the request deadline, took %v", elapsed)
+	}
+	if rec.Msg != nil {
+		t.Errorf("expected query to be passed to next plugin, got reply %v", rec.Msg)
+	}
+}
+
+func TestRouteStop(t *testing.T) {
+	rt := newRoute(RouteConfig{Zones: []string{"."}, To: []string{"10.0.0.1:53"}})
+	config := KubeForwardConfig{Transport: transport.DNS, opts: proxy.Options{HCDomain: "."}}
+	rt.updateForwardServers(rt.static, config)
+	rt.stop()
+
+	// Updates after shutdown do not start upstreams again
+	rt.updateForwardServers(upstreamAddrs{UDP: []upstreamEndpoint{{Addr: "10.0.0.2:53"}}}, config)
+	if upstreams := rt.debugUpstreams(config.Transport); len(upstreams) != 2 || upstreams[0].Address != "10.0.0.1:53" {
+		t.Errorf("expected upstreams of before shutdown, got %+v", upstreams)
+	}
+}
+
+func TestStaticRouteSubset(t *testing.T) {
+	to := []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"}
+	rt := newRoute(RouteConfig{Zones: []string{"."}, Direct: true, To: to})
+	rt.subset = newSubsetter(2, "node-1")
+	rt.updateForwardServers(rt.static, KubeForwardConfig{Transport: transport.DNS, opts: proxy.Options{HCDomain: "."}})
+	defer rt.stop()
+
+	if upstreams := rt.currentUpstreams(context.Background()); len(upstreams.udp) != len(to) || len(upstreams.tcp) != len(to) {
+		t.Errorf("expected all %d static upstreams, got %d UDP and %d TCP", len(to), len(upstreams.udp), len(upstreams.tcp))
+	}
+}
+
+func TestUpdateForwardServersKeepsUpstreams(t *testing.T) {
+	rt := newRoute(RouteConfig{Zones: []string{"."}})
+	config := KubeForwardConfig{Transport: transport.DNS, OutlierDetection: &OutlierConfig{ConsecutiveErrors: 5, Interval: time.Second}, opts: proxy.Options{HCDomain: "."}}
+	endpoints := func(addrs ...string) upstreamAddrs {
+		var servers upstreamAddrs
+		for _, addr := range addrs {
+			servers.UDP = append(servers.UDP, upstreamEndpoint{Addr: addr})
+			servers.TCP = append(servers.TCP, upstreamEndpoint{Addr: addr})
+		}
+		return servers
+	}
+	byAddr := func() map[string]*endpointUpstream {
+		list := make(map[string]*endpointUpstream)
+		for _, u := range rt.currentUpstreams(context.Background()).udp {
+			list[u.Addr()] = u
+		}
+		return list
+	}
+	defer rt.stop()
+
+	rt.updateForwardServers(endpoints("10.0.0.1:53", "10.0.0.2:53"), config)
+	before := byAddr()
+	before["10.0.0.1:53"].outlierStats.consecutiveErrors = 3
+
+	// The unchanged endpoint keeps its upstream and state, the removed one leaves the outlier detector
+	rt.updateForwardServers(endpoints("10.0.0.1:53", "10.0.0.3:53"), config)
+	after := byAddr()
+	if after["10.0.0.1:53"] != before["10.0.0.1:53"] || after["10.0.0.1:53"].outlierStats.consecutiveErrors != 3 {
+		t.Errorf("expected upstream of unchanged endpoint to be kept")
+	}
+	if after["10.0.0.3:53"] == nil || after["10.0.0.3:53"].outlier != after["10.0.0.1:53"].outlier {
+		t.Errorf("expected new upstream in the outlier detector of the route")
+	}
+	if lists := after["10.0.0.1:53"].outlier.lists; len(lists) != 2 || len(lists[0]) != 2 || len(lists[1]) != 2 {
+		t.Errorf("expected UDP and TCP lists of 2 upstreams in the outlier detector, got %v", lists)
+	}
+}
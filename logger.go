@@ -0,0 +1,159 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	golog "log"
+	"log/slog"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Subsystems with their own log level
+const (
+	subsystemDiscovery = "discovery"
+	subsystemForwarder = "forwarder"
+	subsystemSlow      = "slow"
+)
+
+// Log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is the minimal level of messages written by a logger
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"debug":   levelDebug,
+	"info":    levelInfo,
+	"warning": levelWarning,
+	"error":   levelError,
+}
+
+// clogger writes text messages the CoreDNS way: "[INFO] plugin/kubeforward: ..."
+var clogger = clog.NewWithPlugin("kubeforward")
+
+// logger writes messages of one subsystem at or above its level, as clog text or JSON lines.
+// Debug text messages are written only when the CoreDNS debug plugin is enabled, as clog does.
+// A nil logger writes everything from info level as text.
+type logger struct {
+	subsystem string
+	level     logLevel
+	json      *slog.Logger
+}
+
+// loggers maps subsystems to their loggers, "" is the logger for the rest of the plugin.
+// Missing loggers are nil and write with defaults.
+type loggers map[string]*logger
+
+// newLoggers creates loggers with levels set by log_level and format set by log_format
+func newLoggers(levels map[string]string, format string) loggers {
+	var json *slog.Logger
+	if format == logFormatJSON {
+		json = slog.New(slog.NewJSONHandler(golog.Writer(), &slog.HandlerOptions{Level: slog.LevelDebug})).With("plugin", "kubeforward")
+	}
+
+	create := func(subsystem string) *logger {
+		name, ok := levels[subsystem]
+		if !ok {
+			name = levels[""]
+		}
+		level, ok := logLevels[name]
+		if !ok {
+			level = levelInfo
+		}
+		l := &logger{subsystem: subsystem, level: level}
+		if json != nil {
+			l.json = json
+			if subsystem != "" {
+				l.json = json.With("subsystem", subsystem)
+			}
+		}
+		return l
+	}
+
+	return loggers{
+		"":                 create(""),
+		subsystemDiscovery: create(subsystemDiscovery),
+		subsystemForwarder: create(subsystemForwarder),
+		subsystemSlow:      create(subsystemSlow),
+	}
+}
+
+func (l *logger) Debugf(format string, args ...interface{})   { l.logf(levelDebug, format, args...) }
+func (l *logger) Infof(format string, args ...interface{})    { l.logf(levelInfo, format, args...) }
+func (l *logger) Warningf(format string, args ...interface{}) { l.logf(levelWarning, format, args...) }
+func (l *logger) Errorf(format string, args ...interface{})   { l.logf(levelError, format, args...) }
+
+func (l *logger) logf(level logLevel, format string, args ...interface{}) {
+	if l == nil {
+		l = &logger{level: levelInfo}
+	}
+	if level < l.level {
+		return
+	}
+
+	message := fmt.Sprintf(format, args...)
+	if l.json != nil {
+		l.json.Log(context.Background(), slogLevel(level), message)
+		return
+	}
+
+	if l.subsystem != "" {
+		message = l.subsystem + ": " + message
+	}
+	switch level {
+	case levelDebug:
+		clogger.Debug(message)
+	case levelInfo:
+		clogger.Info(message)
+	case levelWarning:
+		clogger.Warning(message)
+	default:
+		clogger.Error(message)
+	}
+}
+
+func slogLevel(level logLevel) slog.Level {
+	switch level {
+	case levelDebug:
+		return slog.LevelDebug
+	case levelInfo:
+		return slog.LevelInfo
+	case levelWarning:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// endpointsDiff returns addresses present only in updated and only in current
+func endpointsDiff(current, updated []upstreamEndpoint) (added, removed []string) {
+	currentAddrs := make(map[string]struct{}, len(current))
+	for _, endpoint := range current {
+		currentAddrs[endpoint.Addr] = struct{}{}
+	}
+	updatedAddrs := make(map[string]struct{}, len(updated))
+	for _, endpoint := range updated {
+		updatedAddrs[endpoint.Addr] = struct{}{}
+		if _, ok := currentAddrs[endpoint.Addr]; !ok {
+			added = append(added, endpoint.Addr)
+		}
+	}
+	for _, endpoint := range current {
+		if _, ok := updatedAddrs[endpoint.Addr]; !ok {
+			removed = append(removed, endpoint.Addr)
+		}
+	}
+
+	return added, removed
+}
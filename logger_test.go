@@ -0,0 +1,82 @@
+package kubeforward
+
+import (
+	"bytes"
+	"encoding/json"
+	golog "log"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoggers(t *testing.T) {
+	tests := []struct {
+		name     string
+		levels   map[string]string
+		format   string
+		expected []string
+	}{
+		{
+			name:     "Default info level",
+			expected: []string{"[INFO] plugin/kubeforward: discovery: info", "[WARNING] plugin/kubeforward: forwarder: warning", "[INFO] plugin/kubeforward: slow: info"},
+		},
+		{
+			name:     "Subsystem level overrides the default",
+			levels:   map[string]string{"": "warning", subsystemSlow: "info"},
+			expected: []string{"[WARNING] plugin/kubeforward: forwarder: warning", "[INFO] plugin/kubeforward: slow: info"},
+		},
+		{
+			name:     "JSON format",
+			levels:   map[string]string{subsystemDiscovery: "error"},
+			format:   logFormatJSON,
+			expected: []string{`forwarder WARN warning`, `slow INFO info`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			output := golog.Writer()
+			golog.SetOutput(&buf)
+			defer golog.SetOutput(output)
+			flags := golog.Flags()
+			golog.SetFlags(0)
+			defer golog.SetFlags(flags)
+
+			log := newLoggers(test.levels, test.format)
+			log[subsystemDiscovery].Debugf("debug")
+			log[subsystemDiscovery].Infof("info")
+			log[subsystemForwarder].Warningf("warning")
+			log[subsystemSlow].Infof("info")
+
+			var lines []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if test.format != logFormatJSON {
+					lines = append(lines, line)
+					continue
+				}
+				var entry map[string]string
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("invalid JSON line %q: %v", line, err)
+				}
+				if entry["plugin"] != "kubeforward" {
+					t.Errorf("expected plugin kubeforward, got %q", entry["plugin"])
+				}
+				lines = append(lines, strings.Join([]string{entry["subsystem"], entry["level"], entry["msg"]}, " "))
+			}
+			if !slices.Equal(lines, test.expected) {
+				t.Errorf("expected lines %q, got %q", test.expected, lines)
+			}
+		})
+	}
+}
+
+func TestEndpointsDiff(t *testing.T) {
+	current := []upstreamEndpoint{{Addr: "10.0.0.1:53"}, {Addr: "10.0.0.2:53"}}
+	updated := []upstreamEndpoint{{Addr: "10.0.0.2:53"}, {Addr: "10.0.0.3:53"}}
+
+	added, removed := endpointsDiff(current, updated)
+	if !slices.Equal(added, []string{"10.0.0.3:53"}) || !slices.Equal(removed, []string{"10.0.0.1:53"}) {
+		t.Errorf("expected added [10.0.0.3:53] removed [10.0.0.1:53], got added %v removed %v", added, removed)
+	}
+}
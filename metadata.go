@@ -0,0 +1,65 @@
+package kubeforward
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+)
+
+// requestMetadata is filled by ServeDNS and read by the metadata value functions
+type requestMetadata struct {
+	result   forwardResult
+	duration time.Duration
+}
+
+type metadataKey struct{}
+
+// Metadata implements the metadata.Provider interface. Values are empty until the query is forwarded.
+func (df *KubeForward) Metadata(ctx context.Context, state request.Request) context.Context {
+	md := &requestMetadata{}
+
+	metadata.SetValueFunc(ctx, "kubeforward/upstream", func() string {
+		if md.result.upstream == nil {
+			return ""
+		}
+		return md.result.upstream.Addr()
+	})
+	metadata.SetValueFunc(ctx, "kubeforward/upstream_pod", func() string {
+		if md.result.upstream == nil {
+			return ""
+		}
+		return md.result.upstream.endpoint.Pod
+	})
+	metadata.SetValueFunc(ctx, "kubeforward/upstream_zone", func() string {
+		if md.result.upstream == nil {
+			return ""
+		}
+		return md.result.upstream.endpoint.Zone
+	})
+	metadata.SetValueFunc(ctx, "kubeforward/attempts", func() string {
+		if md.result.attempts == 0 {
+			return ""
+		}
+		return strconv.Itoa(md.result.attempts)
+	})
+	metadata.SetValueFunc(ctx, "kubeforward/duration", func() string {
+		if md.duration == 0 {
+			return ""
+		}
+		// Same format as {duration} of the log plugin
+		return strconv.FormatFloat(md.duration.Seconds(), 'f', -1, 64) + "s"
+	})
+
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// setMetadata stores how the query was forwarded for the metadata value functions
+func setMetadata(ctx context.Context, result forwardResult, duration time.Duration) {
+	if md, ok := ctx.Value(metadataKey{}).(*requestMetadata); ok {
+		md.result = result
+		md.duration = duration
+	}
+}
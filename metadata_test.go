@@ -0,0 +1,50 @@
+package kubeforward
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestMetadata(t *testing.T) {
+	rt := newTestRoute(".", &fakeUpstream{addr: "10.0.0.1:53"})
+	rt.upstreams.udp[0].endpoint.Pod = "d8-kube-dns-abc"
+	rt.upstreams.udp[0].endpoint.Zone = "zone-a"
+	df := &KubeForward{routes: []*route{rt}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	ctx = df.Metadata(ctx, request.Request{W: rec, Req: req})
+
+	if value := metadata.ValueFunc(ctx, "kubeforward/upstream")(); value != "" {
+		t.Errorf("expected empty upstream before forwarding, got %q", value)
+	}
+
+	if _, err := df.ServeDNS(ctx, rec, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"kubeforward/upstream":      "10.0.0.1:53",
+		"kubeforward/upstream_pod":  "d8-kube-dns-abc",
+		"kubeforward/upstream_zone": "zone-a",
+		"kubeforward/attempts":      "1",
+	}
+	for label, value := range expected {
+		if got := metadata.ValueFunc(ctx, label)(); got != value {
+			t.Errorf("expected %s=%q, got %q", label, value, got)
+		}
+	}
+	if duration := metadata.ValueFunc(ctx, "kubeforward/duration")(); !strings.HasSuffix(duration, "s") {
+		t.Errorf("expected duration in seconds, got %q", duration)
+	}
+}
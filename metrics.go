@@ -13,12 +13,103 @@ var (
 		Name:      "request_duration_seconds",
 		Help:      "Histogram of DNS request duration in kubeforward, in seconds",
 		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
-	}, []string{"qtype", "rcode"})
+	}, []string{"zone", "qtype", "rcode"})
 
 	SlowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "kubeforward",
 		Name:      "slow_requests_total",
 		Help:      "Total number of DNS requests slower than the configured threshold",
-	}, []string{"qtype", "rcode", "upstream"})
+	}, []string{"zone", "qtype", "rcode", "upstream"})
+
+	FallthroughRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "fallthrough_requests_total",
+		Help:      "Total number of DNS requests passed to the next plugin after upstream failure",
+	}, []string{"zone", "reason"})
+
+	OutlierEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "outlier_ejections_total",
+		Help:      "Total number of upstreams ejected by outlier detection",
+	}, []string{"zone", "reason"})
+
+	OutlierEjectionsOverflow = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "outlier_ejections_overflow_total",
+		Help:      "Total number of outlier ejections skipped because of max_ejection_percent",
+	}, []string{"zone", "reason"})
+
+	RateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "ratelimited_requests_total",
+		Help:      "Total number of DNS requests refused or dropped by ratelimit",
+	}, []string{"zone", "scope"})
+
+	RateLimitedTopClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "ratelimited_top_clients",
+		Help:      "Queries over the client limit of ratelimit of the most limited clients, since they are tracked",
+	}, []string{"client"})
+
+	InflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "inflight_requests",
+		Help:      "Number of DNS requests admitted by max_inflight global limit and not answered yet",
+	})
+
+	QueuedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "queued_requests",
+		Help:      "Number of DNS requests waiting in the max_inflight admission queue",
+	})
+
+	OverloadedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "overloaded_requests_total",
+		Help:      "Total number of DNS requests shed by max_inflight",
+	}, []string{"zone", "scope"})
+
+	CoalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "coalesced_requests_total",
+		Help:      "Total number of DNS requests answered with the reply of an identical in-flight request",
+	}, []string{"zone"})
+
+	EmergencyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "emergency_requests_total",
+		Help:      "Total number of DNS requests answered from watched Services because no upstream was healthy",
+	}, []string{"zone", "rcode"})
+
+	EmergencyForwardedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "emergency_forwarded_requests_total",
+		Help:      "Total number of DNS requests forwarded to emergency upstreams because no upstream was healthy",
+	}, []string{"zone", "rcode"})
+
+	RetriedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "retries_total",
+		Help:      "Total number of queries retried to a different upstream, by the rcode or timeout that caused the retry",
+	}, []string{"reason"})
+
+	RetryBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "kubeforward",
+		Name:      "retry_budget_exhausted_total",
+		Help:      "Total number of retries not sent because the retry budget was exhausted",
+	}, []string{"reason"})
 )
@@ -0,0 +1,179 @@
+package kubeforward
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Reasons of outlier ejections
+const (
+	ejectConsecutiveErrors = "consecutive_errors"
+	ejectErrorRatio        = "error_ratio"
+)
+
+const (
+	defaultConsecutiveErrors  = 5
+	defaultOutlierMinRequests = 20
+	defaultOutlierInterval    = 10 * time.Second
+	defaultBaseEjectionTime   = 30 * time.Second
+	defaultMaxEjectionTime    = 300 * time.Second
+	defaultMaxEjectionPercent = 50
+)
+
+// OutlierConfig configures passive outlier detection of outlier_detection.
+type OutlierConfig struct {
+	// ConsecutiveErrors ejects upstream after this many failed queries in a row, 0 disables it
+	ConsecutiveErrors int
+	// ErrorRatio ejects upstream with at least this ratio of failed queries in Interval, 0 disables it
+	ErrorRatio float64
+	// MinRequests is the number of queries in Interval needed to apply ErrorRatio
+	MinRequests int
+	Interval    time.Duration
+	// BaseEjectionTime is multiplied by the number of ejections in a row of the upstream
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// MaxEjectionPercent limits the share of ejected upstreams, one upstream always stays
+	MaxEjectionPercent int
+}
+
+// outlierDetector ejects upstreams of one route that fail real queries.
+type outlierDetector struct {
+	config *OutlierConfig
+	log    *logger
+	// zone is the first zone of the route, for metrics
+	zone string
+	// lists are the UDP and TCP upstreams, max_ejection_percent applies to each of them
+	lists [][]*endpointUpstream
+
+	mu sync.Mutex
+}
+
+// outlierStats are the query outcomes of one upstream, guarded by outlierDetector.mu
+type outlierStats struct {
+	consecutiveErrors int
+	requests          int
+	errors            int
+	windowStart       time.Time
+	// ejections in a row, reset when the upstream stays in for MaxEjectionTime
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func newOutlierDetector(config KubeForwardConfig, zone string) *outlierDetector {
+	return &outlierDetector{config: config.OutlierDetection, log: config.log[subsystemForwarder], zone: zone}
+}
+
+// queryFailed reports if the reply shows a broken upstream; NXDOMAIN and other answers are fine.
+func queryFailed(ret *dns.Msg, err error) bool {
+	if err != nil {
+		return true
+	}
+	return ret.Rcode == dns.RcodeServerFailure || ret.Rcode == dns.RcodeRefused
+}
+
+// setMembers replaces the upstream lists of the detector after an update, new upstreams join it
+func (d *outlierDetector) setMembers(lists ...[]*endpointUpstream) {
+	for _, list := range lists {
+		for _, u := range list {
+			if u.outlier == nil {
+				u.outlier = d
+			}
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lists = lists
+}
+
+// ejected reports if the upstream is currently ejected
+func (u *endpointUpstream) ejected() bool {
+	if u.outlier == nil {
+		return false
+	}
+	u.outlier.mu.Lock()
+	defer u.outlier.mu.Unlock()
+
+	return time.Now().Before(u.outlierStats.ejectedUntil)
+}
+
+// recordOutcome counts the query result of the upstream and ejects it when it is an outlier
+func (u *endpointUpstream) recordOutcome(ret *dns.Msg, err error) {
+	d := u.outlier
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	stats := &u.outlierStats
+	if now.Sub(stats.windowStart) >= d.config.Interval {
+		stats.windowStart = now
+		stats.requests, stats.errors = 0, 0
+	}
+
+	stats.requests++
+	if !queryFailed(ret, err) {
+		stats.consecutiveErrors = 0
+		return
+	}
+	stats.errors++
+	stats.consecutiveErrors++
+
+	if now.Before(stats.ejectedUntil) {
+		return
+	}
+	switch {
+	case d.config.ConsecutiveErrors > 0 && stats.consecutiveErrors >= d.config.ConsecutiveErrors:
+		d.eject(u, now, ejectConsecutiveErrors)
+	case d.config.ErrorRatio > 0 && stats.requests >= d.config.MinRequests && float64(stats.errors)/float64(stats.requests) >= d.config.ErrorRatio:
+		d.eject(u, now, ejectErrorRatio)
+	}
+}
+
+// eject ejects the upstream for the ejection time increasing with every ejection in a row,
+// unless too many upstreams of its UDP or TCP list are ejected already. Called with d.mu held.
+func (d *outlierDetector) eject(u *endpointUpstream, now time.Time, reason string) {
+	stats := &u.outlierStats
+	for _, list := range d.lists {
+		if !slices.Contains(list, u) {
+			continue
+		}
+		if ejected := ejectedCount(list, now); ejected >= maxEjected(len(list), d.config.MaxEjectionPercent) {
+			OutlierEjectionsOverflow.WithLabelValues(d.zone, reason).Inc()
+			d.log.Debugf("upstream %s is an outlier (%s), but %d of %d upstreams are ejected already", u.Addr(), reason, ejected, len(list))
+			return
+		}
+	}
+
+	if !stats.ejectedUntil.IsZero() && now.Sub(stats.ejectedUntil) >= d.config.MaxEjectionTime {
+		stats.ejections = 0
+	}
+	stats.ejections++
+	ejection := min(d.config.BaseEjectionTime*time.Duration(stats.ejections), max(d.config.MaxEjectionTime, d.config.BaseEjectionTime))
+	stats.ejectedUntil = now.Add(ejection)
+	stats.consecutiveErrors = 0
+	stats.windowStart = now
+	stats.requests, stats.errors = 0, 0
+
+	OutlierEjections.WithLabelValues(d.zone, reason).Inc()
+	d.log.Warningf("upstream %s ejected for %v (%s)", u.Addr(), ejection, reason)
+}
+
+func ejectedCount(list []*endpointUpstream, now time.Time) int {
+	ejected := 0
+	for _, u := range list {
+		if now.Before(u.outlierStats.ejectedUntil) {
+			ejected++
+		}
+	}
+	return ejected
+}
+
+// maxEjected is the number of n upstreams allowed to be ejected at once, at least one stays in
+func maxEjected(n, percent int) int {
+	return min(max(n*percent/100, 1), n-1)
+}
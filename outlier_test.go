@@ -0,0 +1,143 @@
+package kubeforward
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestOutlierSet(config OutlierConfig, n int) []*endpointUpstream {
+	list := make([]*endpointUpstream, 0, n)
+	for i := range n {
+		addr := fmt.Sprintf("10.0.0.%d:53", i+1)
+		list = append(list, &endpointUpstream{upstream: &fakeUpstream{addr: addr}, endpoint: upstreamEndpoint{Addr: addr}})
+	}
+	newOutlierDetector(KubeForwardConfig{OutlierDetection: &config}, ".").setMembers(list)
+	return list
+}
+
+func replyWithRcode(rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.Rcode = rcode
+	return m
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	list := newTestOutlierSet(OutlierConfig{
+		ConsecutiveErrors:  3,
+		Interval:           time.Minute,
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}, 4)
+	u := list[0]
+
+	u.recordOutcome(nil, errors.New("timeout"))
+	u.recordOutcome(replyWithRcode(dns.RcodeServerFailure), nil)
+	// NXDOMAIN is a valid answer and resets the errors in a row
+	u.recordOutcome(replyWithRcode(dns.RcodeNameError), nil)
+	u.recordOutcome(replyWithRcode(dns.RcodeRefused), nil)
+	u.recordOutcome(replyWithRcode(dns.RcodeServerFailure), nil)
+	if u.ejected() {
+		t.Fatalf("expected upstream not ejected after 2 errors in a row")
+	}
+
+	u.recordOutcome(nil, errors.New("timeout"))
+	if !u.ejected() {
+		t.Fatalf("expected upstream ejected after 3 errors in a row")
+	}
+	if until := time.Until(u.outlierStats.ejectedUntil); until <= 0 || until > time.Minute {
+		t.Errorf("expected ejection for base ejection time, got %v", until)
+	}
+
+	// Ejection time grows with every ejection in a row
+	u.outlierStats.ejectedUntil = time.Now().Add(-time.Second)
+	for range 3 {
+		u.recordOutcome(nil, errors.New("timeout"))
+	}
+	if until := time.Until(u.outlierStats.ejectedUntil); until <= time.Minute || until > 2*time.Minute {
+		t.Errorf("expected second ejection for twice the base ejection time, got %v", until)
+	}
+}
+
+func TestOutlierErrorRatio(t *testing.T) {
+	list := newTestOutlierSet(OutlierConfig{
+		ErrorRatio:         0.5,
+		MinRequests:        4,
+		Interval:           time.Minute,
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}, 2)
+	u := list[0]
+
+	u.recordOutcome(replyWithRcode(dns.RcodeServerFailure), nil)
+	u.recordOutcome(replyWithRcode(dns.RcodeSuccess), nil)
+	u.recordOutcome(replyWithRcode(dns.RcodeServerFailure), nil)
+	if u.ejected() {
+		t.Fatalf("expected upstream not ejected before min requests")
+	}
+	u.recordOutcome(replyWithRcode(dns.RcodeServerFailure), nil)
+	if !u.ejected() {
+		t.Fatalf("expected upstream ejected with error ratio 0.75")
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams int
+		percent   int
+		expected  int
+	}{
+		{name: "half of four", upstreams: 4, percent: 50, expected: 2},
+		{name: "at least one", upstreams: 4, percent: 10, expected: 1},
+		{name: "one always stays", upstreams: 3, percent: 100, expected: 2},
+		{name: "single upstream is never ejected", upstreams: 1, percent: 100, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := newTestOutlierSet(OutlierConfig{
+				ConsecutiveErrors:  1,
+				Interval:           time.Minute,
+				BaseEjectionTime:   time.Minute,
+				MaxEjectionTime:    time.Minute,
+				MaxEjectionPercent: tt.percent,
+			}, tt.upstreams)
+
+			ejected := 0
+			for _, u := range list {
+				u.recordOutcome(nil, errors.New("timeout"))
+				if u.ejected() {
+					ejected++
+				}
+			}
+			if ejected != tt.expected {
+				t.Errorf("expected %d ejected upstreams, got %d", tt.expected, ejected)
+			}
+		})
+	}
+}
+
+func TestOutlierMaxEjectionPercentPerProtocol(t *testing.T) {
+	config := OutlierConfig{ConsecutiveErrors: 1, Interval: time.Minute, BaseEjectionTime: time.Minute, MaxEjectionTime: time.Minute, MaxEjectionPercent: 50}
+	var udp, tcp []*endpointUpstream
+	for i := range 2 {
+		addr := fmt.Sprintf("10.0.0.%d:53", i+1)
+		udp = append(udp, &endpointUpstream{upstream: &fakeUpstream{addr: addr}, endpoint: upstreamEndpoint{Addr: addr}})
+		tcp = append(tcp, &endpointUpstream{upstream: &fakeUpstream{addr: addr}, endpoint: upstreamEndpoint{Addr: addr}})
+	}
+	newOutlierDetector(KubeForwardConfig{OutlierDetection: &config}, ".").setMembers(udp, tcp)
+
+	// Two Pods with UDP and TCP upstreams each: one UDP upstream stays in, not two of four upstreams
+	for _, u := range udp {
+		u.recordOutcome(nil, errors.New("timeout"))
+	}
+	if !udp[0].ejected() || udp[1].ejected() {
+		t.Errorf("expected only one of two UDP upstreams ejected, got %v and %v", udp[0].ejected(), udp[1].ejected())
+	}
+}
@@ -0,0 +1,173 @@
+package kubeforward
+
+import (
+	"container/list"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// Actions on queries over the limit
+const (
+	rateLimitRefuse = "refuse"
+	rateLimitDrop   = "drop"
+)
+
+// Scopes of the limit a query exceeded
+const (
+	rateLimitGlobal = "global"
+	rateLimitClient = "client"
+)
+
+const (
+	defaultRateLimitMaxClients = 10000
+	// rateLimitTopClients is the number of most limited clients exported by RateLimitedTopClients
+	rateLimitTopClients = 10
+)
+
+// RateLimitConfig configures token-bucket limits of ratelimit.
+type RateLimitConfig struct {
+	// GlobalQPS limits all forwarded queries, 0 disables it
+	GlobalQPS   float64
+	GlobalBurst int
+	// ClientQPS limits forwarded queries of one client address, 0 disables it
+	ClientQPS   float64
+	ClientBurst int
+	// Action is refuse (answer REFUSED) or drop (do not answer)
+	Action string
+	// Allow lists clients that are never limited
+	Allow []netip.Prefix
+	// MaxClients limits the number of tracked client buckets
+	MaxClients int
+}
+
+// rateLimiter enforces the global and per-client limits before queries are forwarded.
+type rateLimiter struct {
+	config *RateLimitConfig
+	global *rate.Limiter
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*list.Element
+	// recent orders the clients from the most to the least recently seen
+	recent *list.List
+	// top are the most limited clients, exported by RateLimitedTopClients
+	top []*clientLimiter
+}
+
+type clientLimiter struct {
+	addr    netip.Addr
+	limiter *rate.Limiter
+	// limited is the number of queries over the limit of the client since it is tracked
+	limited int
+}
+
+func newRateLimiter(config *RateLimitConfig) *rateLimiter {
+	l := &rateLimiter{config: config, clients: make(map[netip.Addr]*list.Element), recent: list.New()}
+	if config.GlobalQPS > 0 {
+		l.global = rate.NewLimiter(rate.Limit(config.GlobalQPS), config.GlobalBurst)
+	}
+	return l
+}
+
+// allow reports if the query of the client may be forwarded, or the scope of the exceeded limit
+func (l *rateLimiter) allow(ip string) (bool, string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true, ""
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range l.config.Allow {
+		if prefix.Contains(addr) {
+			return true, ""
+		}
+	}
+
+	// The client bucket is checked first, so a noisy client does not eat the global tokens
+	if l.config.ClientQPS > 0 && !l.allowClient(addr) {
+		return false, rateLimitClient
+	}
+	if l.global != nil && !l.global.Allow() {
+		return false, rateLimitGlobal
+	}
+
+	return true, ""
+}
+
+// allowClient takes a token from the bucket of the client address. When there are too many
+// clients, the least recently seen one is forgotten, noisy clients keep their buckets.
+func (l *rateLimiter) allowClient(addr netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.clients[addr]
+	if ok {
+		l.recent.MoveToFront(e)
+	} else {
+		if l.recent.Len() >= l.config.MaxClients {
+			l.forget(l.recent.Back())
+		}
+		c := &clientLimiter{addr: addr, limiter: rate.NewLimiter(rate.Limit(l.config.ClientQPS), l.config.ClientBurst)}
+		e = l.recent.PushFront(c)
+		l.clients[addr] = e
+	}
+
+	c := e.Value.(*clientLimiter)
+	if c.limiter.Allow() {
+		return true
+	}
+	c.limited++
+	l.updateTop(c)
+	return false
+}
+
+// forget drops the bucket of the client and its top clients entry
+func (l *rateLimiter) forget(e *list.Element) {
+	c := l.recent.Remove(e).(*clientLimiter)
+	delete(l.clients, c.addr)
+	if i := slices.Index(l.top, c); i >= 0 {
+		l.top = slices.Delete(l.top, i, i+1)
+		RateLimitedTopClients.DeleteLabelValues(c.addr.String())
+	}
+}
+
+// updateTop keeps the rateLimitTopClients most limited clients in RateLimitedTopClients
+func (l *rateLimiter) updateTop(c *clientLimiter) {
+	if !slices.Contains(l.top, c) {
+		if len(l.top) < rateLimitTopClients {
+			l.top = append(l.top, c)
+		} else {
+			least := 0
+			for i, t := range l.top {
+				if t.limited < l.top[least].limited {
+					least = i
+				}
+			}
+			if l.top[least].limited >= c.limited {
+				return
+			}
+			RateLimitedTopClients.DeleteLabelValues(l.top[least].addr.String())
+			l.top[least] = c
+		}
+	}
+	RateLimitedTopClients.WithLabelValues(c.addr.String()).Set(float64(c.limited))
+}
+
+// serveLimited answers the query over the limit with REFUSED or drops it
+func (df *KubeForward) serveLimited(w dns.ResponseWriter, state request.Request, zone, scope string) (int, error) {
+	RateLimitedRequests.WithLabelValues(zone, scope).Inc()
+	df.log[subsystemForwarder].Debugf("rate limited %s %s from %s (%s)", state.Type(), state.Name(), state.IP(), scope)
+
+	if df.rateLimiter.config.Action == rateLimitDrop {
+		return 0, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, dns.RcodeRefused)
+	w.WriteMsg(m)
+	return 0, nil
+}
@@ -0,0 +1,160 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(&RateLimitConfig{
+		GlobalQPS:   0.001,
+		GlobalBurst: 3,
+		ClientQPS:   0.001,
+		ClientBurst: 2,
+		Allow:       []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+		MaxClients:  10,
+	})
+
+	steps := []struct {
+		ip      string
+		allowed bool
+		scope   string
+	}{
+		{ip: "10.1.0.1", allowed: true},
+		{ip: "10.1.0.1", allowed: true},
+		{ip: "10.1.0.1", allowed: false, scope: rateLimitClient},
+		{ip: "::ffff:10.1.0.1", allowed: false, scope: rateLimitClient},
+		{ip: "10.1.0.2", allowed: true},
+		// Global burst of 3 is spent by the two clients
+		{ip: "10.1.0.3", allowed: false, scope: rateLimitGlobal},
+		// Allowed clients are never limited
+		{ip: "10.0.0.5", allowed: true},
+		{ip: "10.0.0.5", allowed: true},
+		{ip: "10.0.0.5", allowed: true},
+	}
+
+	for i, step := range steps {
+		allowed, scope := l.allow(step.ip)
+		if allowed != step.allowed || scope != step.scope {
+			t.Errorf("step %d (%s): expected allowed=%v scope=%q, got allowed=%v scope=%q", i, step.ip, step.allowed, step.scope, allowed, scope)
+		}
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	l := newRateLimiter(&RateLimitConfig{ClientQPS: 0.001, ClientBurst: 1, MaxClients: 2})
+
+	steps := []struct {
+		ip      string
+		allowed bool
+	}{
+		{ip: "10.2.0.1", allowed: true},
+		{ip: "10.2.0.1", allowed: false},
+		{ip: "10.2.0.2", allowed: true},
+		{ip: "10.2.0.2", allowed: false},
+		{ip: "10.2.0.1", allowed: false},
+		// 10.2.0.2 is the least recently seen client and is forgotten
+		{ip: "10.2.0.3", allowed: true},
+		// The noisy client keeps its bucket
+		{ip: "10.2.0.1", allowed: false},
+		{ip: "10.2.0.2", allowed: true},
+	}
+
+	for i, step := range steps {
+		if allowed, _ := l.allow(step.ip); allowed != step.allowed {
+			t.Errorf("step %d (%s): expected allowed=%v, got %v", i, step.ip, step.allowed, allowed)
+		}
+	}
+	if len(l.clients) != 2 || l.recent.Len() != 2 {
+		t.Errorf("expected 2 tracked clients, got %d", len(l.clients))
+	}
+	if n := testutil.ToFloat64(RateLimitedTopClients.WithLabelValues("10.2.0.1")); n != 3 {
+		t.Errorf("expected 3 limited queries of 10.2.0.1, got %v", n)
+	}
+}
+
+func TestRateLimiterTopClients(t *testing.T) {
+	l := newRateLimiter(&RateLimitConfig{ClientQPS: 0.001, ClientBurst: 1, MaxClients: 100})
+
+	limit := func(ip string, queries int) {
+		for range queries + 1 {
+			l.allow(ip)
+		}
+	}
+	for i := range rateLimitTopClients {
+		limit(fmt.Sprintf("10.3.0.%d", i), 2)
+	}
+	// Less limited than all the top clients
+	limit("10.3.1.1", 1)
+	// Displaces a top client
+	limit("10.3.1.2", 3)
+
+	if len(l.top) != rateLimitTopClients {
+		t.Fatalf("expected %d top clients, got %d", rateLimitTopClients, len(l.top))
+	}
+	var top []string
+	for _, c := range l.top {
+		top = append(top, c.addr.String())
+	}
+	if slices.Contains(top, "10.3.1.1") || !slices.Contains(top, "10.3.1.2") {
+		t.Errorf("unexpected top clients: %v", top)
+	}
+	if n := testutil.ToFloat64(RateLimitedTopClients.WithLabelValues("10.3.1.2")); n != 3 {
+		t.Errorf("expected 3 limited queries of 10.3.1.2, got %v", n)
+	}
+}
+
+func TestServeDNSRateLimited(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		expectReply bool
+	}{
+		{name: "refuse", action: rateLimitRefuse, expectReply: true},
+		{name: "drop", action: rateLimitDrop, expectReply: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kf := &KubeForward{
+				Next:        test.NextHandler(dns.RcodeSuccess, nil),
+				routes:      []*route{newTestRoute(".", &fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeSuccess})},
+				rateLimiter: newRateLimiter(&RateLimitConfig{ClientQPS: 0.001, ClientBurst: 1, Action: tc.action, MaxClients: 10}),
+			}
+
+			for i := range 2 {
+				req := new(dns.Msg)
+				req.SetQuestion("example.org.", dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+				if _, err := kf.ServeDNS(context.Background(), rec, req); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if i == 0 {
+					if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess {
+						t.Fatalf("expected first query to be forwarded, got %v", rec.Msg)
+					}
+					continue
+				}
+				if !tc.expectReply {
+					if rec.Msg != nil {
+						t.Errorf("expected limited query to be dropped, got reply %v", rec.Msg)
+					}
+					continue
+				}
+				if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused {
+					t.Errorf("expected REFUSED for limited query, got %v", rec.Msg)
+				}
+			}
+		})
+	}
+}
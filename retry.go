@@ -0,0 +1,103 @@
+package kubeforward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// retryTimeout is the retry condition and metric reason of queries that got no reply
+const retryTimeout = "timeout"
+
+const (
+	defaultRetryAttempts = 2
+	defaultRetryBudget   = 0.2
+	// retryBudgetBurst is the number of retries allowed at once, e.g. right after start
+	retryBudgetBurst = 10
+)
+
+// RetryConfig configures retries of failed queries to a different upstream of retry.
+type RetryConfig struct {
+	// Rcodes of replies that are retried
+	Rcodes []int
+	// Timeout retries queries that timed out, other network errors fail over without it
+	Timeout bool
+	// Attempts is the maximum number of queries sent for one request, including the first one
+	// and not counting failovers after network errors
+	Attempts int
+	// PerTryTimeout bounds every query, 0 leaves it to the upstream read timeout and the request
+	PerTryTimeout time.Duration
+	// Budget is the ratio of retries to requests allowed over all routes
+	Budget float64
+}
+
+// retryPolicy decides if a failed query is retried and keeps the retry budget.
+type retryPolicy struct {
+	config *RetryConfig
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newRetryPolicy(config *RetryConfig) *retryPolicy {
+	return &retryPolicy{config: config, tokens: retryBudgetBurst}
+}
+
+// request adds a share of a retry to the budget for every forwarded request
+func (p *retryPolicy) request() {
+	p.mu.Lock()
+	p.tokens = min(p.tokens+p.config.Budget, retryBudgetBurst)
+	p.mu.Unlock()
+}
+
+// withdraw takes one retry from the budget
+func (p *retryPolicy) withdraw() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tokens < 1 {
+		return false
+	}
+	p.tokens--
+	return true
+}
+
+// reason returns why the reply should be retried, or "" when it should not
+func (p *retryPolicy) reason(ret *dns.Msg) string {
+	if slices.Contains(p.config.Rcodes, ret.Rcode) {
+		return dns.RcodeToString[ret.Rcode]
+	}
+	return ""
+}
+
+// isTimeout reports if the query got no reply in time, as opposed to failing at once, e.g. refused
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// retry reports if one more query may be sent after attempts queries failed for reason
+func (p *retryPolicy) retry(reason string, attempts int) bool {
+	if attempts >= p.config.Attempts {
+		return false
+	}
+	if !p.withdraw() {
+		RetryBudgetExhausted.WithLabelValues(reason).Inc()
+		return false
+	}
+	RetriedRequests.WithLabelValues(reason).Inc()
+	return true
+}
+
+// tryContext bounds one query with the per try timeout
+func (p *retryPolicy) tryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.config.PerTryTimeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, p.config.PerTryTimeout)
+}
@@ -0,0 +1,205 @@
+package kubeforward
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingUpstream counts queries sent to it
+type countingUpstream struct {
+	fakeUpstream
+	queries atomic.Int32
+}
+
+func (u *countingUpstream) Exchange(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	u.queries.Add(1)
+	return u.fakeUpstream.Exchange(ctx, state, opts)
+}
+
+func TestServeDNSRetry(t *testing.T) {
+	tests := []struct {
+		name            string
+		config          RetryConfig
+		upstreams       []fakeUpstream
+		noBudget        bool
+		expectedRcode   int
+		expectedQueries int32
+		// expectedRetries of reason are counted per request
+		reason          string
+		expectedRetries float64
+		expectErr       bool
+	}{
+		{
+			name:          "servfail retried to another upstream",
+			config:        RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 2, Budget: 0.2},
+			upstreams:     []fakeUpstream{{addr: "10.0.0.1:53", rcode: dns.RcodeServerFailure}, {addr: "10.0.0.2:53", rcode: dns.RcodeSuccess}},
+			expectedRcode: dns.RcodeSuccess,
+		},
+		{
+			name:            "timeout retried to another upstream",
+			config:          RetryConfig{Timeout: true, Attempts: 2, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", err: context.DeadlineExceeded}, {addr: "10.0.0.2:53", err: context.DeadlineExceeded}},
+			expectErr:       true,
+			expectedQueries: 2,
+			reason:          retryTimeout,
+			expectedRetries: 1,
+		},
+		{
+			name:            "timeout not retried without timeout condition",
+			config:          RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 2, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", err: context.DeadlineExceeded}, {addr: "10.0.0.2:53", err: context.DeadlineExceeded}},
+			expectErr:       true,
+			expectedQueries: 1,
+		},
+		{
+			name:            "timeout retry bounded by budget",
+			config:          RetryConfig{Timeout: true, Attempts: 2, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", err: context.DeadlineExceeded}, {addr: "10.0.0.2:53", err: context.DeadlineExceeded}},
+			noBudget:        true,
+			expectErr:       true,
+			expectedQueries: 1,
+		},
+		{
+			name:            "every upstream tried once",
+			config:          RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 5, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", rcode: dns.RcodeServerFailure}, {addr: "10.0.0.2:53", rcode: dns.RcodeServerFailure}},
+			expectedRcode:   dns.RcodeServerFailure,
+			expectedQueries: 2,
+			reason:          "SERVFAIL",
+			expectedRetries: 1,
+		},
+		{
+			name:            "bounded by attempts",
+			config:          RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 2, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", rcode: dns.RcodeServerFailure}, {addr: "10.0.0.2:53", rcode: dns.RcodeServerFailure}, {addr: "10.0.0.3:53", rcode: dns.RcodeServerFailure}},
+			expectedRcode:   dns.RcodeServerFailure,
+			expectedQueries: 2,
+		},
+		{
+			name:            "budget exhausted",
+			config:          RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 2, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", rcode: dns.RcodeServerFailure}, {addr: "10.0.0.2:53", rcode: dns.RcodeServerFailure}},
+			noBudget:        true,
+			expectedRcode:   dns.RcodeServerFailure,
+			expectedQueries: 1,
+		},
+		{
+			name:            "rcode not retried",
+			config:          RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 2, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", rcode: dns.RcodeRefused}, {addr: "10.0.0.2:53", rcode: dns.RcodeRefused}},
+			expectedRcode:   dns.RcodeRefused,
+			expectedQueries: 1,
+		},
+		{
+			name:            "network error failed over without timeout condition",
+			config:          RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 2, Budget: 0.2},
+			upstreams:       []fakeUpstream{{addr: "10.0.0.1:53", err: errors.New("connection refused")}, {addr: "10.0.0.2:53", err: errors.New("connection refused")}},
+			expectErr:       true,
+			expectedQueries: 2,
+		},
+		{
+			name:          "network error failed over without budget",
+			config:        RetryConfig{Timeout: true, Attempts: 2, Budget: 0.2},
+			upstreams:     []fakeUpstream{{addr: "10.0.0.1:53", err: errors.New("connection refused")}, {addr: "10.0.0.2:53", err: errors.New("connection refused")}, {addr: "10.0.0.3:53", rcode: dns.RcodeSuccess}},
+			noBudget:      true,
+			expectedRcode: dns.RcodeSuccess,
+		},
+		{
+			name:          "network error failover not counted against attempts",
+			config:        RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Attempts: 2, Budget: 0.2},
+			upstreams:     []fakeUpstream{{addr: "10.0.0.1:53", err: errors.New("connection refused")}, {addr: "10.0.0.2:53", rcode: dns.RcodeServerFailure}, {addr: "10.0.0.3:53", rcode: dns.RcodeSuccess}},
+			expectedRcode: dns.RcodeSuccess,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Upstreams are tried in random order
+			for range 10 {
+				counting := make([]*countingUpstream, 0, len(tc.upstreams))
+				upstreams := make([]upstream, 0, len(tc.upstreams))
+				for _, u := range tc.upstreams {
+					cu := &countingUpstream{fakeUpstream: u}
+					counting = append(counting, cu)
+					upstreams = append(upstreams, cu)
+				}
+				kf := &KubeForward{
+					Next:   test.NextHandler(dns.RcodeSuccess, nil),
+					routes: []*route{newTestRoute(".", upstreams...)},
+					retry:  newRetryPolicy(&tc.config),
+				}
+				if tc.noBudget {
+					kf.retry.tokens = 0
+				}
+
+				req := new(dns.Msg)
+				req.SetQuestion("example.org.", dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+				retried := testutil.ToFloat64(RetriedRequests.WithLabelValues(tc.reason))
+				_, err := kf.ServeDNS(context.Background(), rec, req)
+				if tc.reason != "" {
+					if n := testutil.ToFloat64(RetriedRequests.WithLabelValues(tc.reason)) - retried; n != tc.expectedRetries {
+						t.Errorf("expected %v retries counted, got %v", tc.expectedRetries, n)
+					}
+				}
+				if tc.expectErr {
+					if err == nil {
+						t.Fatalf("expected error, got none")
+					}
+				} else {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if rec.Msg.Rcode != tc.expectedRcode {
+						t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[tc.expectedRcode], dns.RcodeToString[rec.Msg.Rcode])
+					}
+				}
+
+				var queries int32
+				for _, u := range counting {
+					if n := u.queries.Load(); n > 1 {
+						t.Errorf("expected upstream %s to be queried at most once, got %d", u.addr, n)
+					}
+					queries += u.queries.Load()
+				}
+				if tc.expectedQueries != 0 && queries != tc.expectedQueries {
+					t.Fatalf("expected %d queries, got %d", tc.expectedQueries, queries)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	p := newRetryPolicy(&RetryConfig{Attempts: 2, Budget: 0.5})
+
+	for range retryBudgetBurst {
+		if !p.withdraw() {
+			t.Fatalf("expected burst of %d retries", retryBudgetBurst)
+		}
+	}
+	if p.withdraw() {
+		t.Fatalf("expected budget to be exhausted")
+	}
+
+	// Every request adds half a retry
+	p.request()
+	if p.withdraw() {
+		t.Errorf("expected no retry after one request")
+	}
+	p.request()
+	p.request()
+	if !p.withdraw() {
+		t.Errorf("expected retry after two requests")
+	}
+}
@@ -0,0 +1,217 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"k8s.io/client-go/tools/cache"
+)
+
+// discoveryGrace is how long after start queries wait for the first discovery of a route.
+// It is short, so emergency upstreams and fallthrough still have time to answer.
+const discoveryGrace = time.Second
+
+// route forwards queries for its zones to the endpoints of one Service or to static upstreams.
+type route struct {
+	zones       []string
+	namespace   string
+	serviceName string
+	portNames   []string
+	// direct is set for routes that bypass cluster DNS
+	direct bool
+	// static are the upstreams of a direct route without Service
+	static upstreamAddrs
+	// subset is set with subset_size, only the selected endpoints are used
+	subset *subsetter
+	// added is when endpoints were discovered, tracked with slow_start
+	added map[string]time.Time
+	// synced is set once the endpoints at start are known, endpoints found later are new
+	synced bool
+	// outlier is the detector of outlier_detection, kept across updates
+	outlier   *outlierDetector
+	forwardTo upstreamAddrs
+	upstreams *upstreamSet
+	mu        sync.Mutex
+	// discovered is closed when the upstreams are set for the first time
+	discovered chan struct{}
+	// started bounds how long queries wait for the first discovery
+	started time.Time
+	// stopped is set on shutdown, later updates are dropped
+	stopped bool
+	// store all slices
+	slices cache.Store
+	events *eventRecorder
+	log    *logger
+	// conditions reported by events
+	noUpstreams atomic.Bool
+	watchFailed atomic.Bool
+	allDown     atomic.Bool
+	fallback    atomic.Bool
+}
+
+func newRoute(config RouteConfig) *route {
+	rt := &route{
+		zones:       config.Zones,
+		namespace:   config.Namespace,
+		serviceName: config.ServiceName, // kubernetes.io/service-name=d8-kube-dns
+		portNames:   config.PortNames,
+		direct:      config.Direct,
+		discovered:  make(chan struct{}),
+		started:     time.Now(),
+		slices:      cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	for _, addr := range config.To {
+		endpoint := upstreamEndpoint{Addr: addr}
+		rt.static.UDP = append(rt.static.UDP, endpoint)
+		rt.static.TCP = append(rt.static.TCP, endpoint)
+	}
+	return rt
+}
+
+// isStatic reports if the route has static upstreams instead of a Service
+func (rt *route) isStatic() bool {
+	return len(rt.static.UDP) != 0
+}
+
+// source names where the upstreams of the route come from, for logs and events
+func (rt *route) source() string {
+	if rt.isStatic() {
+		return fmt.Sprintf("upstreams %v", addrs(rt.static.UDP))
+	}
+	return fmt.Sprintf("service %s/%s", rt.namespace, rt.serviceName)
+}
+
+// transport is the transport of upstreams that do not set one with appProtocol.
+// Transport and TLS options are meant for cluster DNS, direct routes use plain DNS.
+func (rt *route) transport(defaultTransport string) string {
+	if rt.direct {
+		return transport.DNS
+	}
+	return defaultTransport
+}
+
+// matchRoute returns the route with the longest zone matching qname and that zone.
+func matchRoute(routes []*route, qname string) (*route, string) {
+	var (
+		matched     *route
+		matchedZone string
+	)
+	for _, rt := range routes {
+		zone := plugin.Zones(rt.zones).Matches(qname)
+		if zone != "" && len(zone) > len(matchedZone) {
+			matched, matchedZone = rt, zone
+		}
+	}
+
+	return matched, matchedZone
+}
+
+// currentUpstreams returns the upstreams of the route. Right after start it waits for the first
+// discovery, but not longer than the request or discoveryGrace after start, e.g. while the API
+// is down. Then the set is empty and the query is handled like with no endpoints.
+func (rt *route) currentUpstreams(ctx context.Context) *upstreamSet {
+	select {
+	case <-rt.discovered:
+	default:
+		timer := time.NewTimer(time.Until(rt.started.Add(discoveryGrace)))
+		defer timer.Stop()
+		select {
+		case <-rt.discovered:
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.upstreams == nil {
+		return &upstreamSet{}
+	}
+	return rt.upstreams
+}
+
+// updateForwardServers update list servers for forward requests
+func (rt *route) updateForwardServers(newServers upstreamAddrs, config KubeForwardConfig) {
+	// Static upstreams are all configured resolvers, subset_size selects only among Service endpoints
+	if rt.subset != nil && !rt.isStatic() {
+		newServers = rt.subset.apply(newServers)
+	}
+	if rt.direct {
+		config = resolverConfig(config)
+	}
+
+	rt.mu.Lock()
+	if rt.stopped {
+		rt.mu.Unlock()
+		return
+	}
+	oldUpstreams := rt.upstreams
+	oldServers := rt.forwardTo
+
+	// Upstreams of unchanged endpoints are kept, only the new ones are created
+	newUpstreams, removed := newUpstreamSet(newServers, config, oldUpstreams)
+	if config.OutlierDetection != nil {
+		if rt.outlier == nil {
+			rt.outlier = newOutlierDetector(config, rt.zones[0])
+		}
+		rt.outlier.setMembers(newUpstreams.udp, newUpstreams.tcp)
+	}
+	if config.SlowStart != nil {
+		rt.trackAdded(newServers, newUpstreams, config.SlowStart)
+	}
+
+	// Fill up list servers
+	rt.upstreams = newUpstreams
+	rt.forwardTo = newServers
+	if oldUpstreams == nil {
+		close(rt.discovered)
+	}
+	rt.mu.Unlock()
+
+	for _, u := range removed {
+		u.Stop()
+	}
+
+	rt.logChanges(oldServers, newServers)
+
+	rt.setNoUpstreams(len(newServers.UDP) == 0 && len(newServers.TCP) == 0)
+}
+
+// markSynced marks the endpoints discovered so far as the ones at start, later ones ramp up
+func (rt *route) markSynced() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.synced = true
+}
+
+// stop stops the upstreams of the route and their health checks on shutdown
+func (rt *route) stop() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.stopped = true
+	if rt.upstreams != nil {
+		for _, u := range rt.upstreams.all() {
+			u.Stop()
+		}
+	}
+}
+
+// logChanges logs endpoints added and removed by the update, the full lists only at debug level
+func (rt *route) logChanges(current, updated upstreamAddrs) {
+	addedUDP, removedUDP := endpointsDiff(current.UDP, updated.UDP)
+	addedTCP, removedTCP := endpointsDiff(current.TCP, updated.TCP)
+
+	if len(addedUDP)+len(removedUDP)+len(addedTCP)+len(removedTCP) > 0 {
+		rt.log.Infof("endpoints of %s changed: udp added=%v removed=%v, tcp added=%v removed=%v (now udp=%d tcp=%d)",
+			rt.source(), addedUDP, removedUDP, addedTCP, removedTCP, len(updated.UDP), len(updated.TCP))
+	}
+	rt.log.Debugf("forward servers of zones %v: udp=%v tcp=%v", rt.zones, addrs(updated.UDP), addrs(updated.TCP))
+}
@@ -2,35 +2,96 @@ package kubeforward
 
 import (
 	"context"
-	"log"
-	"sync"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
+// version is reported in the log and to version.kubeforward. CHAOS queries
+const version = "0.5.0"
+
 func init() { plugin.Register("kubeforward", setup) }
 
 func setup(c *caddy.Controller) error {
-	version := "0.5.0"
-
-	log.Printf("\033[34m[kubeforward] version: %s\033[0m\n", version)
-
 	// parse config
 	config, err := ParseConfig(c)
 	if err != nil {
 		return err
 	}
+	pluginLog := config.log[""]
+	pluginLog.Infof("version: %s", version)
 
 	kubeForwardPlugin := &KubeForward{
-		Namespace:      config.Namespace,
-		ServiceName:    config.ServiceName, // kubernetes.io/service-name=d8-kube-dns
-		forwarder:      nil,
-		options:        config.opts,
-		cond:           sync.NewCond(&sync.Mutex{}),
-		slowThreshold:  config.SlowThreshold,
-		slowLogEnabled: config.SlowLogEnabled,
+		except:                 config.Except,
+		fallthroughRcodes:      config.FallthroughRcodes,
+		fallthroughNoUpstreams: config.FallthroughNoUpstreams,
+		clientIdentity:         config.clientIdentity,
+		chaosACL:               config.ChaosACL,
+		transport:              config.Transport,
+		options:                config.opts,
+		slowThreshold:          config.SlowThreshold,
+		slowLogEnabled:         config.SlowLogEnabled,
+		log:                    config.log,
+	}
+	if config.RateLimit != nil {
+		kubeForwardPlugin.rateLimiter = newRateLimiter(config.RateLimit)
+	}
+	if config.Retry != nil {
+		kubeForwardPlugin.retry = newRetryPolicy(config.Retry)
+	}
+	if config.Coalesce {
+		kubeForwardPlugin.coalescer = newCoalescer()
+	}
+	if config.Emergency != nil {
+		kubeForwardPlugin.emergency = newEmergencyResolver(config.Emergency, config.log[subsystemDiscovery])
+	}
+	if config.MaxInflight != nil {
+		kubeForwardPlugin.inflight = newInflightLimiter(config.MaxInflight)
+	}
+
+	var tracerProvider *sdktrace.TracerProvider
+	if config.OTLPEndpoint != "" {
+		tracerProvider, err = newOTLPTracer(config)
+		if err != nil {
+			return err
+		}
+		kubeForwardPlugin.tracer = tracerProvider.Tracer("kubeforward")
+	}
+
+	var events *eventRecorder
+	if config.Events != "" {
+		events, err = newEventRecorder(config.Events)
+		if err != nil {
+			return err
+		}
+	}
+
+	var subset *subsetter
+	if config.SubsetSize > 0 {
+		node := os.Getenv("NODE_NAME")
+		if node == "" {
+			if node, err = os.Hostname(); err != nil {
+				return plugin.Error("kubeforward", fmt.Errorf("subset_size requires NODE_NAME environment variable: %w", err))
+			}
+			pluginLog.Warningf("NODE_NAME environment variable is not set, subset_size selects endpoints for hostname %s", node)
+		}
+		subset = newSubsetter(config.SubsetSize, node)
+	}
+
+	for _, routeConfig := range config.Routes {
+		rt := newRoute(routeConfig)
+		rt.events = events
+		rt.log = config.log[subsystemDiscovery]
+		rt.subset = subset
+		kubeForwardPlugin.routes = append(kubeForwardPlugin.routes, rt)
 	}
 
 	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
@@ -42,25 +103,93 @@ func setup(c *caddy.Controller) error {
 	// Context for properly shutdown goroutine
 	ctx, cancel := context.WithCancel(context.Background())
 
+	var debugServer *http.Server
+
 	c.OnStartup(func() error {
-		log.Printf("[kubeforward] Starting with namespace=%s, service_name=%s\n", config.Namespace, config.ServiceName)
-		// Start go routine for watch EndpointSlice
-		go func() {
-			err := startEndpointSliceWatcher(ctx, config.Namespace, config.ServiceName, config.PortName, func(newServers []string) {
-				kubeForwardPlugin.UpdateForwardServers(newServers, *config)
-				log.Printf("[kubeforward] Updated servers namespace%s, service_name=%s\n: %v", config.Namespace, config.ServiceName, newServers)
-			})
+		if taph := dnsserver.GetConfig(c).Handler("dnstap"); taph != nil {
+			kubeForwardPlugin.setTapPlugin(taph.(*dnstap.Dnstap))
+		}
+
+		if events != nil {
+			if err := events.start(); err != nil {
+				pluginLog.Errorf("failed to start events recorder: %v", err)
+			}
+			for _, rt := range kubeForwardPlugin.routes {
+				go rt.watchHealth(ctx)
+			}
+		}
+
+		if kubeForwardPlugin.emergency != nil {
+			go func() {
+				if err := kubeForwardPlugin.emergency.start(ctx); err != nil {
+					pluginLog.Errorf("failed to start emergency watchers: %v", err)
+				}
+			}()
+		}
+
+		// Emergency upstreams start health checks, like the routes they start only with the server
+		if config.EmergencyUpstreams != nil {
+			kubeForwardPlugin.emergencyUpstreams = newEmergencyForwarder(config.EmergencyUpstreams, *config)
+		}
+
+		for _, rt := range kubeForwardPlugin.routes {
+			if rt.isStatic() {
+				rt.log.Infof("starting with zones=%v, direct to %v", rt.zones, addrs(rt.static.UDP))
+				rt.updateForwardServers(rt.static, *config)
+				rt.markSynced()
+				continue
+			}
+			rt.log.Infof("starting with zones=%v, namespace=%s, service_name=%s", rt.zones, rt.namespace, rt.serviceName)
+			// Start go routine for watch EndpointSlice
+			go func() {
+				err := startEndpointSliceWatcher(ctx, rt.namespace, rt.serviceName, rt.portNames, rt.slices, func(newServers upstreamAddrs) {
+					rt.updateForwardServers(newServers, *config)
+				}, rt.markSynced, rt.setWatchStatus, rt.log)
+				if err != nil {
+					rt.log.Errorf("failed to start EndpointSlice watcher with label kubernetes.io/service-name=%s: %v", rt.serviceName, err)
+					if ctx.Err() == nil {
+						rt.setWatchStatus(err)
+					}
+				}
+			}()
+		}
+
+		if config.DebugListen != "" {
+			ln, err := reuseport.Listen("tcp", config.DebugListen)
 			if err != nil {
-				log.Printf("[kubeforward] Error starting EndpointSlice watcher with label kubernetes.io/service-name=%s: %v", config.ServiceName, err)
+				return plugin.Error("kubeforward", fmt.Errorf("failed to listen debug_listen %s: %w", config.DebugListen, err))
 			}
-		}()
+			debugServer = &http.Server{Handler: kubeForwardPlugin.debugHandler(config), ReadHeaderTimeout: 5 * time.Second}
+			go func() {
+				if err := debugServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+					pluginLog.Errorf("debug server on %s failed: %v", config.DebugListen, err)
+				}
+			}()
+		}
 
 		return nil
 	})
 
 	c.OnShutdown(func() error {
-		log.Printf("[kubeforward] Shutting down with namespace=%s\n", config.Namespace)
+		pluginLog.Infof("shutting down with namespace=%s", config.Namespace)
 		cancel()
+		for _, rt := range kubeForwardPlugin.routes {
+			rt.stop()
+		}
+		if events != nil {
+			events.stop()
+		}
+		if kubeForwardPlugin.emergencyUpstreams != nil {
+			kubeForwardPlugin.emergencyUpstreams.stop()
+		}
+		if tracerProvider != nil {
+			if err := tracerProvider.Shutdown(context.Background()); err != nil {
+				pluginLog.Errorf("failed to flush traces: %v", err)
+			}
+		}
+		if debugServer != nil {
+			return debugServer.Close()
+		}
 		return nil
 	})
 
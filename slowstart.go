@@ -0,0 +1,91 @@
+package kubeforward
+
+import (
+	"cmp"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+const (
+	defaultSlowStartAggression = 1
+	defaultSlowStartMinWeight  = 0.1
+)
+
+// SlowStartConfig configures the ramp of new endpoints of slow_start.
+type SlowStartConfig struct {
+	// Window is the time after discovery until an endpoint gets its full share of queries
+	Window time.Duration
+	// Aggression shapes the ramp: 1 is linear, greater values ramp faster at the beginning
+	Aggression float64
+	// MinWeight is the weight of an endpoint right after discovery
+	MinWeight float64
+}
+
+// slowStart is the ramp of one endpoint discovered at added
+type slowStart struct {
+	config *SlowStartConfig
+	added  time.Time
+}
+
+// weight returns the share of queries of the endpoint relative to warm endpoints
+func (s *slowStart) weight(now time.Time) float64 {
+	elapsed := now.Sub(s.added)
+	if elapsed >= s.config.Window {
+		return 1
+	}
+	progress := math.Max(float64(elapsed)/float64(s.config.Window), 0)
+	return math.Max(math.Pow(progress, 1/s.config.Aggression), s.config.MinWeight)
+}
+
+// weight of the upstream in the random order of exchange
+func (u *endpointUpstream) weight(now time.Time) float64 {
+	if u.slowStart == nil {
+		return 1
+	}
+	return u.slowStart.weight(now)
+}
+
+// trackAdded remembers when the endpoints were discovered and starts the ramp of the new ones.
+// Endpoints discovered until the route is synced are all warm, ramping them all alike makes
+// no difference. Called with rt.mu held.
+func (rt *route) trackAdded(servers upstreamAddrs, upstreams *upstreamSet, config *SlowStartConfig) {
+	now := time.Now()
+	added := make(map[string]time.Time, len(servers.UDP)+len(servers.TCP))
+	for _, endpoint := range slices.Concat(servers.UDP, servers.TCP) {
+		switch at, ok := rt.added[endpoint.Addr]; {
+		case ok:
+			added[endpoint.Addr] = at
+		case !rt.synced:
+			added[endpoint.Addr] = time.Time{}
+		default:
+			added[endpoint.Addr] = now
+		}
+	}
+	rt.added = added
+
+	// Upstreams kept from the previous update have their ramp already
+	for _, u := range upstreams.all() {
+		if at := added[u.endpoint.Addr]; u.slowStart == nil && now.Sub(at) < config.Window {
+			u.slowStart = &slowStart{config: config, added: at}
+		}
+	}
+}
+
+// shuffleUpstreams puts the upstreams in random order. Upstreams in slow start come first
+// less often, in proportion to their weight.
+func shuffleUpstreams(list []*endpointUpstream) {
+	now := time.Now()
+	if !slices.ContainsFunc(list, func(u *endpointUpstream) bool { return u.weight(now) < 1 }) {
+		rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+		return
+	}
+
+	// Weighted random order of Efraimidis and Spirakis: sort by descending random^(1/weight)
+	keys := make(map[*endpointUpstream]float64, len(list))
+	for _, u := range list {
+		keys[u] = math.Pow(rand.Float64(), 1/u.weight(now))
+	}
+	slices.SortFunc(list, func(a, b *endpointUpstream) int { return cmp.Compare(keys[b], keys[a]) })
+}
@@ -0,0 +1,107 @@
+package kubeforward
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowStartWeight(t *testing.T) {
+	added := time.Now()
+	tests := []struct {
+		name     string
+		config   SlowStartConfig
+		elapsed  time.Duration
+		expected float64
+	}{
+		{name: "just added", config: SlowStartConfig{Window: 10 * time.Second, Aggression: 1, MinWeight: 0.1}, elapsed: 0, expected: 0.1},
+		{name: "linear", config: SlowStartConfig{Window: 10 * time.Second, Aggression: 1, MinWeight: 0.1}, elapsed: 5 * time.Second, expected: 0.5},
+		{name: "aggressive", config: SlowStartConfig{Window: 10 * time.Second, Aggression: 2, MinWeight: 0.1}, elapsed: 2500 * time.Millisecond, expected: 0.5},
+		{name: "warm", config: SlowStartConfig{Window: 10 * time.Second, Aggression: 1, MinWeight: 0.1}, elapsed: time.Minute, expected: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &slowStart{config: &tc.config, added: added}
+			if weight := s.weight(added.Add(tc.elapsed)); weight != tc.expected {
+				t.Errorf("expected weight %v, got %v", tc.expected, weight)
+			}
+		})
+	}
+}
+
+func TestSlowStartTrackAdded(t *testing.T) {
+	config := &SlowStartConfig{Window: time.Minute, Aggression: 1, MinWeight: 0.1}
+	rt := newRoute(RouteConfig{Zones: []string{"."}})
+	upstreamsOf := func(servers upstreamAddrs) *upstreamSet {
+		set := &upstreamSet{}
+		for _, endpoint := range servers.UDP {
+			set.udp = append(set.udp, &endpointUpstream{upstream: &fakeUpstream{addr: endpoint.Addr}, endpoint: endpoint})
+		}
+		return set
+	}
+	weights := func(set *upstreamSet) map[string]float64 {
+		now := time.Now()
+		list := make(map[string]float64)
+		for _, u := range set.all() {
+			list[u.endpoint.Addr] = u.weight(now)
+		}
+		return list
+	}
+
+	// Endpoints discovered until the route is synced are warm, e.g. of several slices or after an empty update
+	rt.trackAdded(upstreamAddrs{}, upstreamsOf(upstreamAddrs{}), config)
+	rt.trackAdded(upstreamAddrs{UDP: []upstreamEndpoint{{Addr: "10.0.0.1:53"}}}, upstreamsOf(upstreamAddrs{}), config)
+	first := upstreamAddrs{UDP: []upstreamEndpoint{{Addr: "10.0.0.1:53"}, {Addr: "10.0.0.2:53"}}}
+	set := upstreamsOf(first)
+	rt.trackAdded(first, set, config)
+	for addr, weight := range weights(set) {
+		if weight != 1 {
+			t.Errorf("expected %s to be warm, got weight %v", addr, weight)
+		}
+	}
+	rt.markSynced()
+
+	// A new endpoint ramps up, the known ones stay warm across updates
+	second := upstreamAddrs{UDP: []upstreamEndpoint{{Addr: "10.0.0.1:53"}, {Addr: "10.0.0.2:53"}, {Addr: "10.0.0.3:53"}}}
+	set = upstreamsOf(second)
+	rt.trackAdded(second, set, config)
+	got := weights(set)
+	if got["10.0.0.1:53"] != 1 || got["10.0.0.2:53"] != 1 || got["10.0.0.3:53"] >= 0.2 {
+		t.Errorf("expected only the new endpoint to ramp up, got %v", got)
+	}
+
+	// The ramp of the new endpoint continues with the next update
+	added := rt.added["10.0.0.3:53"]
+	set = upstreamsOf(second)
+	rt.trackAdded(second, set, config)
+	if rt.added["10.0.0.3:53"] != added || weights(set)["10.0.0.3:53"] >= 0.2 {
+		t.Errorf("expected the ramp to be kept across updates")
+	}
+
+	// Removed endpoints are forgotten and ramp up again when they come back
+	rt.trackAdded(first, upstreamsOf(first), config)
+	if _, ok := rt.added["10.0.0.3:53"]; ok {
+		t.Errorf("expected removed endpoint to be forgotten")
+	}
+}
+
+func TestShuffleUpstreamsWeighted(t *testing.T) {
+	config := &SlowStartConfig{Window: time.Minute, Aggression: 1, MinWeight: 0.1}
+	warm := &endpointUpstream{upstream: &fakeUpstream{addr: "10.0.0.1:53"}}
+	cold := &endpointUpstream{upstream: &fakeUpstream{addr: "10.0.0.2:53"}, slowStart: &slowStart{config: config, added: time.Now()}}
+
+	const rounds = 10000
+	coldFirst := 0
+	for range rounds {
+		list := []*endpointUpstream{warm, cold}
+		shuffleUpstreams(list)
+		if list[0] == cold {
+			coldFirst++
+		}
+	}
+
+	// The weight 0.1 of the cold endpoint against 1 of the warm one, about 9% of the queries
+	if share := float64(coldFirst) / rounds; share < 0.06 || share > 0.12 {
+		t.Errorf("expected the cold endpoint first in about 9%% of the rounds, got %.1f%%", share*100)
+	}
+}
@@ -0,0 +1,83 @@
+package kubeforward
+
+import (
+	"cmp"
+	"hash/fnv"
+	"net"
+	"slices"
+)
+
+// subsetter selects the same subset of endpoints on a node with rendezvous hashing,
+// so every endpoint is used by about the same number of nodes and churn moves few of them.
+type subsetter struct {
+	size int
+	node string
+}
+
+func newSubsetter(size int, node string) *subsetter {
+	return &subsetter{size: size, node: node}
+}
+
+// apply selects the subset of both lists. Endpoints are selected by address, so UDP and TCP
+// queries go to the same Pods.
+func (s *subsetter) apply(servers upstreamAddrs) upstreamAddrs {
+	return upstreamAddrs{UDP: s.selectEndpoints(servers.UDP), TCP: s.selectEndpoints(servers.TCP)}
+}
+
+// selectEndpoints returns up to size endpoints with the highest scores for the node.
+// Endpoints are taken from zones in turn, so the subset spans zones when topology is known.
+func (s *subsetter) selectEndpoints(endpoints []upstreamEndpoint) []upstreamEndpoint {
+	if len(endpoints) <= s.size {
+		return endpoints
+	}
+
+	type scored struct {
+		endpoint upstreamEndpoint
+		score    uint64
+	}
+	zones := make(map[string][]scored)
+	for _, endpoint := range endpoints {
+		zones[endpoint.Zone] = append(zones[endpoint.Zone], scored{endpoint: endpoint, score: s.score(endpoint)})
+	}
+
+	// Zones are visited in order of their best endpoint, which is stable as well
+	byScore := func(a, b scored) int { return cmp.Compare(b.score, a.score) }
+	order := make([][]scored, 0, len(zones))
+	for _, list := range zones {
+		slices.SortFunc(list, byScore)
+		order = append(order, list)
+	}
+	slices.SortFunc(order, func(a, b []scored) int { return byScore(a[0], b[0]) })
+
+	selected := make([]upstreamEndpoint, 0, s.size)
+	for i := 0; len(selected) < s.size; i++ {
+		for _, list := range order {
+			if i < len(list) && len(selected) < s.size {
+				selected = append(selected, list[i].endpoint)
+			}
+		}
+	}
+
+	return selected
+}
+
+// score is the rendezvous hash of the node and the endpoint address
+func (s *subsetter) score(endpoint upstreamEndpoint) uint64 {
+	host, _, err := net.SplitHostPort(endpoint.Addr)
+	if err != nil {
+		host = endpoint.Addr
+	}
+	h := fnv.New64a()
+	h.Write([]byte(s.node))
+	h.Write([]byte{0})
+	h.Write([]byte(host))
+
+	// FNV of similar strings differs in few bits, mix them all (splitmix64 finalizer)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,100 @@
+package kubeforward
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+)
+
+func testEndpoints(n int, port string, zones ...string) []upstreamEndpoint {
+	endpoints := make([]upstreamEndpoint, 0, n)
+	for i := range n {
+		endpoint := upstreamEndpoint{Addr: fmt.Sprintf("10.0.%d.%d:%s", i/250, i%250+1, port)}
+		if len(zones) != 0 {
+			endpoint.Zone = zones[i%len(zones)]
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+func TestSubsetSelect(t *testing.T) {
+	s := newSubsetter(3, "node-1")
+	servers := upstreamAddrs{UDP: testEndpoints(20, "53"), TCP: testEndpoints(20, "5353")}
+
+	subset := s.apply(servers)
+	if len(subset.UDP) != 3 || len(subset.TCP) != 3 {
+		t.Fatalf("expected 3 endpoints per protocol, got %v", subset)
+	}
+	for i := range subset.UDP {
+		if hostOf(subset.UDP[i]) != hostOf(subset.TCP[i]) {
+			t.Errorf("expected UDP and TCP subsets of the same Pods, got %v and %v", addrs(subset.UDP), addrs(subset.TCP))
+		}
+	}
+
+	// The order of endpoints does not matter
+	reversed := slices.Clone(servers.UDP)
+	slices.Reverse(reversed)
+	if !slices.Equal(addrs(s.selectEndpoints(reversed)), addrs(subset.UDP)) {
+		t.Errorf("expected the same subset for reordered endpoints")
+	}
+
+	// Removing an endpoint out of the subset does not change it, removing one of the subset replaces only it
+	for _, removed := range servers.UDP {
+		rest := slices.DeleteFunc(slices.Clone(servers.UDP), func(e upstreamEndpoint) bool { return e.Addr == removed.Addr })
+		changed := 0
+		for _, e := range s.selectEndpoints(rest) {
+			if !slices.Contains(subset.UDP, e) {
+				changed++
+			}
+		}
+		expected := 0
+		if slices.Contains(subset.UDP, removed) {
+			expected = 1
+		}
+		if changed != expected {
+			t.Errorf("removing %s: expected %d endpoints replaced, got %d", removed.Addr, expected, changed)
+		}
+	}
+
+	if small := testEndpoints(2, "53"); len(s.selectEndpoints(small)) != 2 {
+		t.Errorf("expected all endpoints when there are fewer than the subset size")
+	}
+}
+
+func TestSubsetZones(t *testing.T) {
+	s := newSubsetter(4, "node-1")
+	subset := s.selectEndpoints(testEndpoints(30, "53", "zone-a", "zone-b"))
+
+	perZone := make(map[string]int)
+	for _, e := range subset {
+		perZone[e.Zone]++
+	}
+	if perZone["zone-a"] != 2 || perZone["zone-b"] != 2 {
+		t.Errorf("expected subset balanced over zones, got %v", perZone)
+	}
+}
+
+func TestSubsetSpread(t *testing.T) {
+	endpoints := testEndpoints(10, "53")
+	load := make(map[string]int)
+	for i := range 1000 {
+		s := newSubsetter(2, fmt.Sprintf("node-%d", i))
+		for _, e := range s.selectEndpoints(endpoints) {
+			load[e.Addr]++
+		}
+	}
+
+	// 1000 nodes with 2 of 10 endpoints each, about 200 nodes per endpoint
+	for _, e := range endpoints {
+		if n := load[e.Addr]; n < 150 || n > 250 {
+			t.Errorf("expected about 200 nodes using %s, got %d", e.Addr, n)
+		}
+	}
+}
+
+func hostOf(endpoint upstreamEndpoint) string {
+	host, _, _ := net.SplitHostPort(endpoint.Addr)
+	return host
+}
@@ -0,0 +1,146 @@
+package kubeforward
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// querySpan is the span of one forwarded query. It is created by the tracer of the CoreDNS
+// trace plugin, when it traces the query, or by the OTLP tracer configured with otlp.
+type querySpan interface {
+	setTag(key string, value interface{})
+	setError(err error)
+	traceID() string
+	finish()
+}
+
+// startSpan starts span of the query as child of the trace plugin span, or as OTLP span
+func (df *KubeForward) startSpan(ctx context.Context, state request.Request, zone string) (context.Context, querySpan) {
+	var span querySpan
+	if parent := ot.SpanFromContext(ctx); parent != nil {
+		child := parent.Tracer().StartSpan(df.Name(), ot.ChildOf(parent.Context()))
+		ctx = ot.ContextWithSpan(ctx, child)
+		span = &otSpan{child}
+	} else if df.tracer != nil {
+		var otelSpan trace.Span
+		ctx, otelSpan = df.tracer.Start(ctx, df.Name(), trace.WithSpanKind(trace.SpanKindClient))
+		span = &otelSpanWrapper{otelSpan}
+	} else {
+		return ctx, noopSpan{}
+	}
+
+	span.setTag("dns.qname", state.Name())
+	span.setTag("dns.qtype", state.Type())
+	span.setTag("kubeforward.zone", zone)
+
+	return ctx, span
+}
+
+// setResult tags the span with the upstream that answered and the number of attempts
+func setResult(span querySpan, result forwardResult) {
+	if result.upstream != nil {
+		span.setTag("kubeforward.upstream", result.upstream.Addr())
+	}
+	span.setTag("kubeforward.attempts", result.attempts)
+	span.setTag("kubeforward.retries", max(result.attempts-1, 0))
+}
+
+// otSpan is a span of the trace plugin tracer
+type otSpan struct{ ot.Span }
+
+func (s *otSpan) setTag(key string, value interface{}) { s.SetTag(key, value) }
+
+func (s *otSpan) setError(err error) {
+	s.SetTag("error", true)
+	s.LogKV("event", "error", "message", err.Error())
+}
+
+// traceID extracts trace ID from the headers the tracer propagates (zipkin B3 and datadog)
+func (s *otSpan) traceID() string {
+	carrier := ot.TextMapCarrier{}
+	if err := s.Tracer().Inject(s.Context(), ot.TextMap, carrier); err != nil {
+		return ""
+	}
+	for key, value := range carrier {
+		switch strings.ToLower(key) {
+		case "x-b3-traceid", "x-datadog-trace-id":
+			return value
+		}
+	}
+	return ""
+}
+
+func (s *otSpan) finish() { s.Finish() }
+
+// otelSpanWrapper is a span of the OTLP tracer
+type otelSpanWrapper struct{ trace.Span }
+
+func (s *otelSpanWrapper) setTag(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.SetAttributes(attribute.String(key, v))
+	case int:
+		s.SetAttributes(attribute.Int(key, v))
+	case bool:
+		s.SetAttributes(attribute.Bool(key, v))
+	}
+}
+
+func (s *otelSpanWrapper) setError(err error) {
+	s.RecordError(err)
+	s.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpanWrapper) traceID() string {
+	if !s.SpanContext().IsSampled() {
+		return ""
+	}
+	return s.SpanContext().TraceID().String()
+}
+
+func (s *otelSpanWrapper) finish() { s.End() }
+
+// noopSpan is used when the query is not traced
+type noopSpan struct{}
+
+func (noopSpan) setTag(string, interface{}) {}
+func (noopSpan) setError(error)             {}
+func (noopSpan) traceID() string            { return "" }
+func (noopSpan) finish()                    {}
+
+// exemplar links the metric sample to the trace
+func exemplar(traceID string) prometheus.Labels {
+	if traceID == "" {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": traceID}
+}
+
+// newOTLPTracer creates tracer provider exporting spans to the otlp gRPC endpoint
+func newOTLPTracer(config *KubeForwardConfig) (*sdktrace.TracerProvider, error) {
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.OTLPEndpoint)}
+	if config.OTLPInsecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("otlp: failed to create exporter: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.OTLPSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "kubeforward"), attribute.String("service.version", version))),
+	), nil
+}
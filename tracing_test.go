@@ -0,0 +1,113 @@
+package kubeforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestServeDNSTracing(t *testing.T) {
+	tests := []struct {
+		name             string
+		upstreams        []upstream
+		expectedRcode    string
+		expectedAttempts int
+		expectedUpstream string
+	}{
+		{
+			name:             "Answer from first upstream",
+			upstreams:        []upstream{&fakeUpstream{addr: "10.0.0.1:53", rcode: dns.RcodeNameError}},
+			expectedRcode:    "NXDOMAIN",
+			expectedAttempts: 1,
+			expectedUpstream: "10.0.0.1:53",
+		},
+		{
+			name: "Down upstream is skipped",
+			upstreams: []upstream{
+				&fakeUpstream{addr: "10.0.0.1:53", err: errors.New("timeout"), fails: maxFails},
+				&fakeUpstream{addr: "10.0.0.2:53", rcode: dns.RcodeSuccess},
+			},
+			expectedRcode:    "NOERROR",
+			expectedAttempts: 1,
+			expectedUpstream: "10.0.0.2:53",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("otlp/"+tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			df := &KubeForward{routes: []*route{newTestRoute(".", tt.upstreams...)}, tracer: provider.Tracer("kubeforward")}
+
+			serveTraced(t, df, context.Background())
+
+			spans := recorder.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("expected one span, got %d", len(spans))
+			}
+			attributes := make(map[string]string)
+			for _, attr := range spans[0].Attributes() {
+				attributes[string(attr.Key)] = attr.Value.Emit()
+			}
+			assertSpanTags(t, tt.expectedRcode, tt.expectedUpstream, tt.expectedAttempts, attributes)
+		})
+
+		t.Run("trace plugin/"+tt.name, func(t *testing.T) {
+			tracer := mocktracer.New()
+			df := &KubeForward{routes: []*route{newTestRoute(".", tt.upstreams...)}}
+
+			parent := tracer.StartSpan("servedns")
+			serveTraced(t, df, ot.ContextWithSpan(context.Background(), parent))
+
+			spans := tracer.FinishedSpans()
+			if len(spans) != 1 || spans[0].OperationName != "kubeforward" {
+				t.Fatalf("expected kubeforward span, got %v", spans)
+			}
+			if spans[0].ParentID != parent.Context().(mocktracer.MockSpanContext).SpanID {
+				t.Errorf("expected span to be child of the trace plugin span")
+			}
+			tags := make(map[string]string)
+			for key, value := range spans[0].Tags() {
+				tags[key] = fmt.Sprint(value)
+			}
+			assertSpanTags(t, tt.expectedRcode, tt.expectedUpstream, tt.expectedAttempts, tags)
+		})
+	}
+}
+
+func serveTraced(t *testing.T, df *KubeForward, ctx context.Context) {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := df.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func assertSpanTags(t *testing.T, rcode, upstream string, attempts int, tags map[string]string) {
+	t.Helper()
+
+	expected := map[string]string{
+		"dns.qname":            "example.org.",
+		"dns.qtype":            "A",
+		"dns.rcode":            rcode,
+		"kubeforward.zone":     ".",
+		"kubeforward.upstream": upstream,
+		"kubeforward.attempts": fmt.Sprint(attempts),
+	}
+	for key, value := range expected {
+		if tags[key] != value {
+			t.Errorf("expected tag %s=%q, got %q", key, value, tags[key])
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package kubeforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/pkg/up"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// transportH2C is DNS-over-HTTPS without TLS (HTTP/2 over cleartext), there is no such constant in coredns.
+const transportH2C = "h2c"
+
+const (
+	hcInterval  = 500 * time.Millisecond
+	hcTimeout   = time.Second
+	maxFails    = 2
+	dohMimeType = "application/dns-message"
+	// doqNoError is the DoQ application error code for closing a connection without an error (RFC 9250)
+	doqNoError = 0
+)
+
+// upstream is one discovered endpoint reachable over some transport.
+type upstream interface {
+	// Addr returns the address of the endpoint
+	Addr() string
+	// Exchange sends the request and waits for a response
+	Exchange(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error)
+	// Healthcheck kicks off a round of health checks
+	Healthcheck()
+	// Down returns true if the upstream has more fails than maxfails
+	Down(maxfails uint32) bool
+	// Fails returns the number of failed health checks in a row
+	Fails() uint32
+	// Start starts health checking and connection management
+	Start(hcInterval time.Duration)
+	// Stop stops health checking and closes the connections
+	Stop()
+}
+
+// endpointTransport returns transport for the EndpointSlice port appProtocol,
+// falling back to the configured one for unknown values.
+func endpointTransport(appProtocol, defaultTransport string) string {
+	switch appProtocol {
+	case "dns":
+		return transport.DNS
+	case "dns-tls", "dot":
+		return transport.TLS
+	case "dns-doh", "doh", "https", "kubernetes.io/https":
+		return transport.HTTPS
+	case "kubernetes.io/h2c":
+		return transportH2C
+	case "dns-doq", "doq":
+		return transport.QUIC
+	default:
+		return defaultTransport
+	}
+}
+
+// newUpstream creates upstream for the endpoint; tcp selects health checks over TCP for plain DNS.
+func newUpstream(server upstreamEndpoint, config KubeForwardConfig, tcp bool) (upstream, error) {
+	trans := endpointTransport(server.AppProtocol, config.Transport)
+
+	var tlsConfig *tls.Config
+	if trans == transport.TLS || trans == transport.HTTPS || trans == transport.QUIC {
+		var err error
+		if tlsConfig, err = endpointTLSConfig(config, server); err != nil {
+			return nil, err
+		}
+	}
+
+	switch trans {
+	case transport.DNS, transport.TLS:
+		proxyInstance := proxy.NewProxy(server.Addr, server.Addr, trans)
+		if tlsConfig != nil {
+			proxyInstance.SetTLSConfig(tlsConfig)
+		}
+		proxyInstance.SetExpire(config.Expire)
+		proxyInstance.SetReadTimeout(config.UpstreamReadTimeout)
+		// healthcheck settings are not taken from proxy.Options by proxy itself
+		proxyInstance.GetHealthchecker().SetDomain(config.opts.HCDomain)
+		proxyInstance.GetHealthchecker().SetRecursionDesired(config.opts.HCRecursionDesired)
+		client := &dns.Client{Net: "udp", TLSConfig: tlsConfig}
+		switch {
+		case tlsConfig != nil:
+			client.Net = "tcp-tls"
+		case tcp:
+			proxyInstance.GetHealthchecker().SetTCPTransport()
+			client.Net = "tcp"
+		}
+		return &dnsUpstream{Proxy: proxyInstance, client: client, readTimeout: config.UpstreamReadTimeout}, nil
+	case transport.HTTPS, transportH2C:
+		return newDoHUpstream(server.Addr, config, tlsConfig), nil
+	case transport.QUIC:
+		return newDoQUpstream(server.Addr, config, tlsConfig), nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %s", trans)
+	}
+}
+
+// dnsUpstream is plain DNS or DNS-over-TLS upstream served by proxy.Proxy.
+type dnsUpstream struct {
+	*proxy.Proxy
+	// client sends active health checks over the protocol the upstream serves
+	client *dns.Client
+	// readTimeout is how long proxy.Proxy waits for a reply, it does not watch the context
+	readTimeout time.Duration
+}
+
+func (u *dnsUpstream) Exchange(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < u.readTimeout {
+		return u.exchangeUntil(ctx, state, opts)
+	}
+	return u.connect(ctx, state, opts)
+}
+
+// exchangeUntil sends the query over its own connection that is closed at the context deadline,
+// pooled connections of proxy.Proxy wait for the reply until the read timeout.
+func (u *dnsUpstream) exchangeUntil(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: u.client.TLSConfig, Timeout: u.readTimeout}
+	if client.TLSConfig == nil {
+		// Protocol is chosen like by proxy.Proxy
+		switch {
+		case opts.ForceTCP:
+			client.Net = "tcp"
+		case opts.PreferUDP:
+			client.Net = "udp"
+		default:
+			client.Net = state.Proto()
+		}
+	}
+	ret, _, err := client.ExchangeContext(ctx, state.Req, u.Addr())
+	return ret, err
+}
+
+func (u *dnsUpstream) connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	for {
+		ret, err := u.Connect(ctx, state, opts)
+		// Remote side closed conn, can only happen with TCP.
+		if errors.Is(err, proxy.ErrCachedClosed) {
+			continue
+		}
+		return ret, err
+	}
+}
+
+func (u *dnsUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ret, _, err := u.client.ExchangeContext(ctx, m, u.Addr())
+	return ret, err
+}
+
+// upstreamHealth tracks fails of upstreams that are not served by proxy.Proxy.
+// Like proxy.Proxy it only probes after a failed query, until the upstream answers again.
+type upstreamHealth struct {
+	fails            uint32
+	probe            *up.Probe
+	domain           string
+	recursionDesired bool
+}
+
+func newUpstreamHealth(config KubeForwardConfig) upstreamHealth {
+	return upstreamHealth{
+		probe:            up.New(),
+		domain:           config.opts.HCDomain,
+		recursionDesired: config.opts.HCRecursionDesired,
+	}
+}
+
+func (h *upstreamHealth) Fails() uint32 { return atomic.LoadUint32(&h.fails) }
+
+func (h *upstreamHealth) Down(maxfails uint32) bool {
+	if maxfails == 0 {
+		return false
+	}
+	return atomic.LoadUint32(&h.fails) > maxfails
+}
+
+// check sends the health check query via exchange, anything that parses as a reply is healthy.
+func (h *upstreamHealth) check(exchange func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)) {
+	h.probe.Do(func() error {
+		ping := new(dns.Msg)
+		ping.SetQuestion(h.domain, dns.TypeNS)
+		ping.RecursionDesired = h.recursionDesired
+
+		ctx, cancel := context.WithTimeout(context.Background(), hcTimeout)
+		defer cancel()
+		if _, err := exchange(ctx, ping); err != nil {
+			atomic.AddUint32(&h.fails, 1)
+			return err
+		}
+		atomic.StoreUint32(&h.fails, 0)
+		return nil
+	})
+}
+
+// dohUpstream is DNS-over-HTTPS (RFC 8484) upstream; h2c upstreams use HTTP/2 without TLS.
+type dohUpstream struct {
+	upstreamHealth
+	addr      string
+	url       string
+	client    *http.Client
+	transport *http.Transport
+}
+
+func newDoHUpstream(addr string, config KubeForwardConfig, tlsConfig *tls.Config) *dohUpstream {
+	httpTransport := &http.Transport{
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   config.Expire,
+		MaxIdleConns:      0,
+	}
+	scheme := "https"
+	if tlsConfig == nil {
+		scheme = "http"
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		httpTransport.Protocols = protocols
+	}
+
+	return &dohUpstream{
+		upstreamHealth: newUpstreamHealth(config),
+		addr:           addr,
+		url:            scheme + "://" + addr + config.DoHPath,
+		client:         &http.Client{Transport: httpTransport, Timeout: config.UpstreamReadTimeout},
+		transport:      httpTransport,
+	}
+}
+
+func (u *dohUpstream) Addr() string { return u.addr }
+
+func (u *dohUpstream) Exchange(ctx context.Context, state request.Request, _ proxy.Options) (*dns.Msg, error) {
+	return exchangeWithZeroID(ctx, state.Req, u.exchange)
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMimeType)
+	req.Header.Set("Accept", dohMimeType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected DoH status from %s: %s", u.addr, resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, dohMimeType) {
+		return nil, fmt.Errorf("unexpected DoH content type from %s: %s", u.addr, contentType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (u *dohUpstream) Healthcheck() { u.check(u.exchange) }
+
+func (u *dohUpstream) Start(hcInterval time.Duration) { u.probe.Start(hcInterval) }
+
+func (u *dohUpstream) Stop() {
+	u.probe.Stop()
+	u.transport.CloseIdleConnections()
+}
+
+// doqUpstream is DNS-over-QUIC (RFC 9250) upstream, one QUIC connection is reused for all queries.
+type doqUpstream struct {
+	upstreamHealth
+	addr        string
+	tlsConfig   *tls.Config
+	quicConfig  *quic.Config
+	readTimeout time.Duration
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+func newDoQUpstream(addr string, config KubeForwardConfig, tlsConfig *tls.Config) *doqUpstream {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+
+	return &doqUpstream{
+		upstreamHealth: newUpstreamHealth(config),
+		addr:           addr,
+		tlsConfig:      tlsConfig,
+		quicConfig:     &quic.Config{MaxIdleTimeout: config.Expire},
+		readTimeout:    config.UpstreamReadTimeout,
+	}
+}
+
+func (u *doqUpstream) Addr() string { return u.addr }
+
+func (u *doqUpstream) Exchange(ctx context.Context, state request.Request, _ proxy.Options) (*dns.Msg, error) {
+	return u.exchange(ctx, state.Req)
+}
+
+// exchange sends queries and health checks alike with message ID 0, RFC 9250 requires it
+// and servers close the connection on other IDs.
+func (u *doqUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return exchangeWithZeroID(ctx, m, u.send)
+}
+
+func (u *doqUpstream) send(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := u.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// Connection is broken, dial a new one on the next query
+		u.resetConnection(conn)
+		return nil, err
+	}
+	defer stream.CancelRead(doqNoError)
+
+	deadline := time.Now().Add(u.readTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := stream.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// Every message is prefixed with two-octet length, the client closes the stream after the query
+	if _, err := stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(buf)))); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// connection returns established QUIC connection, dialing a new one if needed.
+func (u *doqUpstream) connection(ctx context.Context) (*quic.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil && u.conn.Context().Err() == nil {
+		return u.conn, nil
+	}
+
+	conn, err := quic.DialAddr(ctx, u.addr, u.tlsConfig, u.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	u.conn = conn
+
+	return conn, nil
+}
+
+func (u *doqUpstream) resetConnection(conn *quic.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == conn {
+		u.conn = nil
+	}
+	_ = conn.CloseWithError(doqNoError, "")
+}
+
+func (u *doqUpstream) Healthcheck() { u.check(u.exchange) }
+
+func (u *doqUpstream) Start(hcInterval time.Duration) { u.probe.Start(hcInterval) }
+
+func (u *doqUpstream) Stop() {
+	u.probe.Stop()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil {
+		_ = u.conn.CloseWithError(doqNoError, "")
+		u.conn = nil
+	}
+}
+
+// exchangeWithZeroID sends a copy of the request with message ID 0, as DoH recommends and DoQ requires,
+// and restores the original ID in the response.
+func exchangeWithZeroID(ctx context.Context, req *dns.Msg, exchange func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	m := req.Copy()
+	m.Id = 0
+
+	ret, err := exchange(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = req.Id
+
+	return ret, nil
+}
@@ -0,0 +1,313 @@
+package kubeforward
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func testUpstreamConfig() KubeForwardConfig {
+	return KubeForwardConfig{
+		Expire:              10 * time.Second,
+		UpstreamReadTimeout: 2 * time.Second,
+		DoHPath:             "/dns-query",
+		opts:                proxy.Options{HCRecursionDesired: true, HCDomain: "."},
+	}
+}
+
+// answer replies to the query with A record 192.0.2.1
+func answer(req *dns.Msg) *dns.Msg {
+	res := new(dns.Msg)
+	res.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 30 IN A 192.0.2.1")
+	res.Answer = append(res.Answer, rr)
+	return res
+}
+
+func dohHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohMimeType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Id != 0 {
+			t.Errorf("expected DoH query with id 0, got %d", req.Id)
+		}
+		buf, _ := answer(req).Pack()
+		w.Header().Set("Content-Type", dohMimeType)
+		w.Write(buf)
+	})
+}
+
+func assertAnswer(t *testing.T, u upstream) {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.Id = 4242
+
+	ret, err := u.Exchange(context.Background(), request.Request{Req: req}, proxy.Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ret.Id != req.Id {
+		t.Errorf("expected reply id %d, got %d", req.Id, ret.Id)
+	}
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer: %v", ret.Answer)
+	}
+}
+
+func TestDoHUpstream(t *testing.T) {
+	t.Run("HTTPS", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(dohHandler(t))
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		defer srv.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		config := testUpstreamConfig()
+		config.Transport = transport.HTTPS
+		config.TLSConfig = &tls.Config{RootCAs: roots}
+
+		u, err := newUpstream(upstreamEndpoint{Addr: srv.Listener.Addr().String()}, config, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer u.Stop()
+
+		assertAnswer(t, u)
+	})
+
+	t.Run("h2c inferred from appProtocol", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(dohHandler(t))
+		srv.Config.Protocols = new(http.Protocols)
+		srv.Config.Protocols.SetUnencryptedHTTP2(true)
+		srv.Start()
+		defer srv.Close()
+
+		config := testUpstreamConfig()
+		config.Transport = transport.DNS
+		endpoint := upstreamEndpoint{Addr: srv.Listener.Addr().String(), AppProtocol: "kubernetes.io/h2c"}
+
+		u, err := newUpstream(endpoint, config, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer u.Stop()
+
+		assertAnswer(t, u)
+	})
+}
+
+func TestDNSUpstreamDeadline(t *testing.T) {
+	// The listener never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	config := testUpstreamConfig()
+	config.Transport = transport.DNS
+	u, err := newUpstream(upstreamEndpoint{Addr: pc.LocalAddr().String()}, config, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer u.Stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.Id = 4242
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := u.Exchange(ctx, request.Request{W: &test.ResponseWriter{}, Req: req}, proxy.Options{}); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected query to be abandoned at the deadline, took %v", elapsed)
+	}
+	if req.Id != 4242 {
+		t.Errorf("expected query id to stay %d, got %d", 4242, req.Id)
+	}
+}
+
+func TestDNSUpstreamDeadlineAnswer(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answer(r))
+	})
+	defer s.Close()
+
+	config := testUpstreamConfig()
+	config.Transport = transport.DNS
+	u, err := newUpstream(upstreamEndpoint{Addr: s.Addr}, config, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer u.Stop()
+
+	// A deadline before the read timeout sends the query over its own connection
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ret, err := u.Exchange(ctx, request.Request{W: &test.ResponseWriter{}, Req: req}, proxy.Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer: %v", ret.Answer)
+	}
+}
+
+// doqProtocolError is the DoQ application error code of DOQ_PROTOCOL_ERROR (RFC 9250)
+const doqProtocolError = 2
+
+func TestDoQUpstream(t *testing.T) {
+	cert, roots := selfSignedCert(t)
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					var length uint16
+					if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+						return
+					}
+					buf := make([]byte, length)
+					if _, err := io.ReadFull(stream, buf); err != nil {
+						return
+					}
+					req := new(dns.Msg)
+					if err := req.Unpack(buf); err != nil {
+						return
+					}
+					// Like the DoQ server of CoreDNS, reject non-zero message IDs of RFC 9250
+					if req.Id != 0 {
+						conn.CloseWithError(doqProtocolError, "")
+						return
+					}
+					res, _ := answer(req).Pack()
+					stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(res))))
+					stream.Write(res)
+					stream.Close()
+				}
+			}()
+		}
+	}()
+
+	config := testUpstreamConfig()
+	config.Transport = transport.QUIC
+	config.TLSConfig = &tls.Config{RootCAs: roots}
+
+	u, err := newUpstream(upstreamEndpoint{Addr: listener.Addr().String()}, config, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer u.Stop()
+
+	// Second query reuses the connection
+	assertAnswer(t, u)
+	assertAnswer(t, u)
+
+	// Health checks are sent with message ID 0 as well
+	ping := new(dns.Msg)
+	ping.SetQuestion(".", dns.TypeNS)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := u.(checkExchanger).exchange(ctx, ping); err != nil {
+		t.Errorf("unexpected health check error: %v", err)
+	}
+	assertAnswer(t, u)
+}
+
+func TestEndpointTransport(t *testing.T) {
+	tests := []struct {
+		appProtocol string
+		expected    string
+	}{
+		{appProtocol: "", expected: transport.DNS},
+		{appProtocol: "kubernetes.io/h2c", expected: transportH2C},
+		{appProtocol: "dns-doh", expected: transport.HTTPS},
+		{appProtocol: "dns-doq", expected: transport.QUIC},
+		{appProtocol: "dns-tls", expected: transport.TLS},
+		{appProtocol: "custom", expected: transport.DNS},
+	}
+
+	for _, test := range tests {
+		if got := endpointTransport(test.appProtocol, transport.DNS); got != test.expected {
+			t.Errorf("expected transport %q for appProtocol %q, got %q", test.expected, test.appProtocol, got)
+		}
+	}
+}
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
@@ -1,24 +1,76 @@
 package kubeforward
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/parse"
 	"github.com/coredns/coredns/plugin/pkg/proxy"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/miekg/dns"
 )
 
+// RouteConfig is a `route` sub-block: queries for Zones are forwarded to the endpoints of the Service.
+type RouteConfig struct {
+	Zones       []string
+	Namespace   string
+	ServiceName string
+	PortNames   []string
+	// Direct routes bypass cluster DNS, their upstreams use plain DNS unless the endpoints say otherwise
+	Direct bool `json:",omitempty"`
+	// To are static upstreams of a direct route, used instead of a Service
+	To []string `json:",omitempty"`
+}
+
 type KubeForwardConfig struct {
-	Namespace           string
-	ServiceName         string
-	PortName            string
-	Expire              time.Duration
-	UpstreamReadTimeout time.Duration
-	SlowThreshold       time.Duration
-	SlowLogEnabled      bool
-	opts                proxy.Options
+	Namespace              string
+	ServiceName            string
+	PortNames              []string
+	Expire                 time.Duration
+	UpstreamReadTimeout    time.Duration
+	SlowThreshold          time.Duration
+	SlowLogEnabled         bool
+	Transport              string
+	TLSConfig              *tls.Config `json:"-"`
+	TLSServerName          string
+	DoHPath                string
+	DebugListen            string
+	ChaosACL               []netip.Prefix
+	Events                 string
+	LogLevels              map[string]string
+	LogFormat              string
+	OTLPEndpoint           string
+	OTLPInsecure           bool
+	OTLPSampleRatio        float64
+	HealthCheck            *HealthCheckConfig
+	OutlierDetection       *OutlierConfig
+	RateLimit              *RateLimitConfig
+	MaxInflight            *MaxInflightConfig
+	Coalesce               bool
+	Emergency              *EmergencyConfig
+	EmergencyUpstreams     *EmergencyUpstreamsConfig
+	Retry                  *RetryConfig
+	AdaptiveTimeout        *AdaptiveTimeoutConfig
+	SubsetSize             int
+	SlowStart              *SlowStartConfig
+	Routes                 []RouteConfig
+	Except                 []string
+	FallthroughRcodes      []int
+	FallthroughNoUpstreams bool
+	clientIdentity         *clientIdentity
+	log                    loggers
+	opts                   proxy.Options
 }
 
 // ParseConfig parse conf CoreFile
@@ -28,6 +80,7 @@ func ParseConfig(c *caddy.Controller) (*KubeForwardConfig, error) {
 		UpstreamReadTimeout: 300 * time.Second, // Default value
 		SlowThreshold:       0,
 		SlowLogEnabled:      false,
+		DoHPath:             "/dns-query",
 		opts: proxy.Options{
 			ForceTCP:           false,
 			PreferUDP:          false,
@@ -51,10 +104,10 @@ func ParseConfig(c *caddy.Controller) (*KubeForwardConfig, error) {
 			}
 			config.ServiceName = c.Val()
 		case "port_name":
-			if !c.NextArg() {
+			config.PortNames = c.RemainingArgs()
+			if len(config.PortNames) == 0 {
 				return nil, c.ArgErr()
 			}
-			config.PortName = c.Val()
 		case "expire":
 			if !c.NextArg() {
 				return nil, c.ArgErr()
@@ -82,21 +135,117 @@ func ParseConfig(c *caddy.Controller) (*KubeForwardConfig, error) {
 						return nil, fmt.Errorf("health_check: invalid domain name %s", hcDomain)
 					}
 					config.opts.HCDomain = plugin.Name(hcDomain).Normalize()
+				case "{":
+					if config.HealthCheck == nil {
+						config.HealthCheck = &HealthCheckConfig{Interval: hcInterval}
+					}
+					if err := parseHealthCheck(c, config.HealthCheck); err != nil {
+						return nil, err
+					}
 				default:
-					if _, err := time.ParseDuration(val); err == nil {
-						return nil, fmt.Errorf("health_check duration is not supported by kubeforward; use upstream_read_timeout")
+					interval, err := time.ParseDuration(val)
+					if err != nil {
+						return nil, fmt.Errorf("health_check: unknown option %s", val)
+					}
+					if interval <= 0 {
+						return nil, fmt.Errorf("health_check: interval must be positive, got %s", val)
 					}
-					return nil, fmt.Errorf("health_check: unknown option %s", val)
+					if config.HealthCheck == nil {
+						config.HealthCheck = &HealthCheckConfig{}
+					}
+					config.HealthCheck.Interval = interval
 				}
-				if !c.NextArg() {
+				if val == "{" || !c.NextArg() {
 					break
 				}
 			}
 
+		case "outlier_detection":
+			outlier, err := parseOutlierDetection(c)
+			if err != nil {
+				return nil, err
+			}
+			config.OutlierDetection = outlier
+		case "ratelimit":
+			rateLimit, err := parseRateLimit(c)
+			if err != nil {
+				return nil, err
+			}
+			config.RateLimit = rateLimit
+		case "emergency":
+			emergency := &EmergencyConfig{Zone: defaultEmergencyZone, TTL: defaultEmergencyTTL}
+			args := c.RemainingArgs()
+			if len(args) > 0 && args[0] != "ttl" {
+				if _, ok := dns.IsDomainName(args[0]); !ok {
+					return nil, fmt.Errorf("emergency: invalid zone %s", args[0])
+				}
+				emergency.Zone = plugin.Name(args[0]).Normalize()
+				args = args[1:]
+			}
+			switch {
+			case len(args) == 2 && args[0] == "ttl":
+				ttl, err := strconv.ParseUint(args[1], 10, 32)
+				if err != nil || ttl == 0 || ttl > 3600 {
+					return nil, fmt.Errorf("emergency: invalid ttl %s, must be in range 1-3600", args[1])
+				}
+				emergency.TTL = uint32(ttl)
+			case len(args) != 0:
+				return nil, c.ArgErr()
+			}
+			config.Emergency = emergency
+		case "emergency_upstreams":
+			emergencyUpstreams, err := parseEmergencyUpstreams(c)
+			if err != nil {
+				return nil, err
+			}
+			config.EmergencyUpstreams = emergencyUpstreams
+		case "retry":
+			retry, err := parseRetry(c)
+			if err != nil {
+				return nil, err
+			}
+			config.Retry = retry
+		case "subset_size":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			size, err := strconv.Atoi(c.Val())
+			if err != nil || size < 1 {
+				return nil, fmt.Errorf("subset_size: invalid size %s", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			config.SubsetSize = size
+		case "slow_start":
+			slowStart, err := parseSlowStart(c)
+			if err != nil {
+				return nil, err
+			}
+			config.SlowStart = slowStart
+		case "coalesce":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			config.Coalesce = true
+		case "max_inflight":
+			maxInflight, err := parseMaxInflight(c)
+			if err != nil {
+				return nil, err
+			}
+			config.MaxInflight = maxInflight
 		case "upstream_read_timeout":
 			if !c.NextArg() {
 				return nil, c.ArgErr()
 			}
+			if c.Val() == "adaptive" {
+				adaptive, err := parseAdaptiveTimeout(c)
+				if err != nil {
+					return nil, err
+				}
+				config.AdaptiveTimeout = adaptive
+				break
+			}
 			duration, err := time.ParseDuration(c.Val())
 			if err != nil {
 				return nil, fmt.Errorf("invalid upstream_read_timeout duration: %v", err)
@@ -120,16 +269,860 @@ func ParseConfig(c *caddy.Controller) (*KubeForwardConfig, error) {
 			config.opts.ForceTCP = true
 		case "prefer_udp":
 			config.opts.PreferUDP = true
+		case "tls":
+			args := c.RemainingArgs()
+			if len(args) > 3 {
+				return nil, c.ArgErr()
+			}
+			root := dnsserver.GetConfig(c).Root
+			for i := range args {
+				if !filepath.IsAbs(args[i]) && root != "" {
+					args[i] = filepath.Join(root, args[i])
+				}
+			}
+			tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tls config: %v", err)
+			}
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+			config.TLSConfig = tlsConfig
+		case "route", "direct":
+			route, err := parseRoute(c)
+			if err != nil {
+				return nil, err
+			}
+			config.Routes = append(config.Routes, route)
+		case "log_level":
+			args := c.RemainingArgs()
+			subsystem := ""
+			switch len(args) {
+			case 1:
+			case 2:
+				subsystem = args[0]
+				if subsystem != subsystemDiscovery && subsystem != subsystemForwarder && subsystem != subsystemSlow {
+					return nil, fmt.Errorf("log_level: unknown subsystem %s", subsystem)
+				}
+				args = args[1:]
+			default:
+				return nil, c.ArgErr()
+			}
+			if _, ok := logLevels[args[0]]; !ok {
+				return nil, fmt.Errorf("log_level: unknown level %s", args[0])
+			}
+			if config.LogLevels == nil {
+				config.LogLevels = make(map[string]string)
+			}
+			config.LogLevels[subsystem] = args[0]
+		case "log_format":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			if c.Val() != logFormatText && c.Val() != logFormatJSON {
+				return nil, fmt.Errorf("log_format: unknown format %s", c.Val())
+			}
+			config.LogFormat = c.Val()
+		case "otlp":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			config.OTLPEndpoint = args[0]
+			config.OTLPSampleRatio = 1
+			for i := 1; i < len(args); i++ {
+				switch args[i] {
+				case "insecure":
+					config.OTLPInsecure = true
+				case "sample":
+					if i+1 >= len(args) {
+						return nil, c.ArgErr()
+					}
+					i++
+					ratio, err := strconv.ParseFloat(args[i], 64)
+					if err != nil || ratio < 0 || ratio > 1 {
+						return nil, fmt.Errorf("otlp: invalid sample ratio %s", args[i])
+					}
+					config.OTLPSampleRatio = ratio
+				default:
+					return nil, fmt.Errorf("otlp: unknown option %s", args[i])
+				}
+			}
+		case "events":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			if c.Val() != "pod" && c.Val() != "node" {
+				return nil, fmt.Errorf("events: unknown object %s, expected pod or node", c.Val())
+			}
+			config.Events = c.Val()
+		case "chaos":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, arg := range args {
+				prefix, err := parsePrefix(arg)
+				if err != nil {
+					return nil, fmt.Errorf("chaos: %v", err)
+				}
+				config.ChaosACL = append(config.ChaosACL, prefix)
+			}
+		case "except":
+			except := c.RemainingArgs()
+			if len(except) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, zone := range except {
+				config.Except = append(config.Except, plugin.Host(zone).NormalizeExact()...)
+			}
+		case "fallthrough_on":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, arg := range args {
+				if arg == "no_upstreams" {
+					config.FallthroughNoUpstreams = true
+					continue
+				}
+				rcode, ok := dns.StringToRcode[strings.ToUpper(arg)]
+				if !ok {
+					return nil, fmt.Errorf("fallthrough_on: unknown rcode %s", arg)
+				}
+				config.FallthroughRcodes = append(config.FallthroughRcodes, rcode)
+			}
+		case "client_identity":
+			identity, err := parseClientIdentity(c)
+			if err != nil {
+				return nil, err
+			}
+			config.clientIdentity = identity
+		case "debug_listen":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+				return nil, fmt.Errorf("invalid debug_listen address: %v", err)
+			}
+			config.DebugListen = c.Val()
+		case "transport":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch c.Val() {
+			case transport.DNS, transport.TLS, transport.HTTPS, transportH2C, transport.QUIC:
+				config.Transport = c.Val()
+			default:
+				return nil, fmt.Errorf("transport: unknown transport %s", c.Val())
+			}
+		case "doh_path":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			if !strings.HasPrefix(c.Val(), "/") {
+				return nil, fmt.Errorf("doh_path must start with /: %s", c.Val())
+			}
+			config.DoHPath = c.Val()
+		case "tls_servername":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			config.TLSServerName = c.Val()
 
 		default:
 			return nil, c.Errf("unknown parameter: %s", c.Val())
 		}
 	}
 
-	// Checking the required parameters
-	if config.Namespace == "" || config.ServiceName == "" || config.PortName == "" {
-		return nil, fmt.Errorf("namespace, servicename, and portname are required parameters")
+	// Checking the required parameters, they can be omitted only when routes are configured
+	if config.Namespace != "" || config.ServiceName != "" || len(config.PortNames) != 0 || len(config.Routes) == 0 {
+		if config.Namespace == "" || config.ServiceName == "" || len(config.PortNames) == 0 {
+			return nil, fmt.Errorf("namespace, servicename, and portname are required parameters")
+		}
+		// Top level Service serves everything not matched by routes
+		config.Routes = append(config.Routes, RouteConfig{
+			Zones:       []string{"."},
+			Namespace:   config.Namespace,
+			ServiceName: config.ServiceName,
+			PortNames:   config.PortNames,
+		})
+	}
+
+	// The first route of a zone would silently shadow the others
+	zones := make(map[string]struct{})
+	for _, route := range config.Routes {
+		for _, zone := range route.Zones {
+			if _, ok := zones[zone]; ok {
+				return nil, fmt.Errorf("zone %s is served by more than one route", zone)
+			}
+			zones[zone] = struct{}{}
+		}
+	}
+
+	// tls without explicit transport means DNS-over-TLS
+	if config.Transport == "" {
+		config.Transport = transport.DNS
+		if config.TLSConfig != nil {
+			config.Transport = transport.TLS
+		}
 	}
 
+	if config.TLSServerName != "" {
+		if config.TLSConfig == nil && config.Transport != transport.HTTPS && config.Transport != transport.QUIC {
+			return nil, fmt.Errorf("tls_servername requires tls")
+		}
+		// Server name with placeholders is resolved for every endpoint
+		if config.TLSConfig != nil && !strings.Contains(config.TLSServerName, "{") {
+			config.TLSConfig.ServerName = config.TLSServerName
+		}
+	}
+
+	if hc := config.HealthCheck; hc != nil {
+		if hc.Timeout == 0 {
+			hc.Timeout = hcTimeout
+		}
+		if hc.QName == "" {
+			hc.QName, hc.QType = config.opts.HCDomain, dns.TypeNS
+		}
+		if hc.Rise == 0 {
+			hc.Rise = defaultHealthRise
+		}
+		if hc.Fall == 0 {
+			hc.Fall = defaultHealthFall
+		}
+	}
+
+	// Upstreams never wait longer than the adaptive timeout can grow
+	if adaptive := config.AdaptiveTimeout; adaptive != nil {
+		config.UpstreamReadTimeout = adaptive.Max
+	}
+	// Nor longer than a try, queries given up on do not keep their sockets
+	if retry := config.Retry; retry != nil && retry.PerTryTimeout > 0 {
+		config.UpstreamReadTimeout = min(config.UpstreamReadTimeout, retry.PerTryTimeout)
+	}
+
+	// Cluster names are left to the emergency resolver or fail, the resolvers outside cannot answer them
+	if eu := config.EmergencyUpstreams; eu != nil && len(eu.ClusterZones) == 0 {
+		eu.ClusterZones = []string{defaultEmergencyZone}
+		if config.Emergency != nil {
+			eu.ClusterZones = []string{config.Emergency.Zone}
+		}
+	}
+
+	config.log = newLoggers(config.LogLevels, config.LogFormat)
+
 	return config, nil
 }
+
+// parseEmergencyUpstreams parses `emergency_upstreams [TO...] [cluster_zones ZONE...]`
+func parseEmergencyUpstreams(c *caddy.Controller) (*EmergencyUpstreamsConfig, error) {
+	args := c.RemainingArgs()
+	to := args
+	var zones []string
+	if i := slices.Index(args, "cluster_zones"); i >= 0 {
+		to, zones = args[:i], args[i+1:]
+		if len(zones) == 0 {
+			return nil, c.ArgErr()
+		}
+	}
+	if len(to) == 0 {
+		to = []string{defaultEmergencyResolvConf}
+	}
+
+	servers, err := parse.HostPortOrFile(to...)
+	if err != nil {
+		return nil, fmt.Errorf("emergency_upstreams: %w", err)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("emergency_upstreams: no nameservers found in %v", to)
+	}
+	for _, server := range servers {
+		if strings.Contains(server, "://") {
+			return nil, fmt.Errorf("emergency_upstreams: only plain DNS is supported: %s", server)
+		}
+	}
+
+	emergencyUpstreams := &EmergencyUpstreamsConfig{To: servers}
+	for _, zone := range zones {
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return nil, fmt.Errorf("emergency_upstreams: invalid zone %s", zone)
+		}
+		emergencyUpstreams.ClusterZones = append(emergencyUpstreams.ClusterZones, plugin.Name(zone).Normalize())
+	}
+
+	return emergencyUpstreams, nil
+}
+
+// parseClientIdentity parses `client_identity ecs [PREFIX4 [PREFIX6]]` or `client_identity local CODE`
+func parseClientIdentity(c *caddy.Controller) (*clientIdentity, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+
+	identity := &clientIdentity{mode: args[0], prefix4: 32, prefix6: 128}
+	switch identity.mode {
+	case clientIdentityECS:
+		if len(args) > 3 {
+			return nil, c.ArgErr()
+		}
+		prefixes := []*uint8{&identity.prefix4, &identity.prefix6}
+		for i, arg := range args[1:] {
+			prefix, err := strconv.ParseUint(arg, 10, 8)
+			if err != nil || (i == 0 && prefix > 32) || prefix > 128 {
+				return nil, fmt.Errorf("client_identity: invalid prefix length %s", arg)
+			}
+			*prefixes[i] = uint8(prefix)
+		}
+	case clientIdentityLocal:
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		code, err := strconv.ParseUint(args[1], 0, 16)
+		if err != nil || code < dns.EDNS0LOCALSTART || code > dns.EDNS0LOCALEND {
+			return nil, fmt.Errorf("client_identity: invalid local option code %s, must be in range %d-%d", args[1], dns.EDNS0LOCALSTART, dns.EDNS0LOCALEND)
+		}
+		identity.code = uint16(code)
+	default:
+		return nil, fmt.Errorf("client_identity: unknown mode %s", identity.mode)
+	}
+
+	return identity, nil
+}
+
+// parseRoute parses `route ZONE... { namespace ..., service_name ..., port_name ... }` sub-block
+// and `direct ZONE... { to ... }` that may also name a Service.
+func parseRoute(c *caddy.Controller) (RouteConfig, error) {
+	directive := c.Val()
+	route := RouteConfig{Direct: directive == "direct"}
+
+	for _, zone := range c.RemainingArgs() {
+		route.Zones = append(route.Zones, plugin.Host(zone).NormalizeExact()...)
+	}
+	if len(route.Zones) == 0 {
+		return route, c.ArgErr()
+	}
+
+	if !c.NextArg() || c.Val() != "{" {
+		return route, c.Errf("%s %v: expected block", directive, route.Zones)
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		switch c.Val() {
+		case "namespace":
+			if !c.NextArg() {
+				return route, c.ArgErr()
+			}
+			route.Namespace = c.Val()
+		case "service_name":
+			if !c.NextArg() {
+				return route, c.ArgErr()
+			}
+			route.ServiceName = c.Val()
+		case "port_name":
+			route.PortNames = c.RemainingArgs()
+			if len(route.PortNames) == 0 {
+				return route, c.ArgErr()
+			}
+		case "to":
+			if !route.Direct {
+				return route, c.Errf("route: unknown parameter: %s", c.Val())
+			}
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return route, c.ArgErr()
+			}
+			servers, err := parse.HostPortOrFile(args...)
+			if err != nil {
+				return route, fmt.Errorf("direct %v: %w", route.Zones, err)
+			}
+			for _, server := range servers {
+				if strings.Contains(server, "://") {
+					return route, fmt.Errorf("direct %v: only plain DNS is supported: %s", route.Zones, server)
+				}
+			}
+			route.To = append(route.To, servers...)
+		default:
+			return route, c.Errf("%s: unknown parameter: %s", directive, c.Val())
+		}
+	}
+
+	if len(route.To) != 0 {
+		if route.Namespace != "" || route.ServiceName != "" || len(route.PortNames) != 0 {
+			return route, fmt.Errorf("direct %v: either to or a Service can be given", route.Zones)
+		}
+		return route, nil
+	}
+	if route.Namespace == "" || route.ServiceName == "" || len(route.PortNames) == 0 {
+		return route, fmt.Errorf("%s %v: namespace, servicename, and portname are required parameters", directive, route.Zones)
+	}
+
+	return route, nil
+}
+
+// parseHealthCheck parses `health_check ... { timeout ..., query ..., expect ..., rise ..., fall ... }` sub-block
+func parseHealthCheck(c *caddy.Controller, hc *HealthCheckConfig) error {
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		switch c.Val() {
+		case "timeout":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			timeout, err := time.ParseDuration(c.Val())
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("health_check: invalid timeout %s", c.Val())
+			}
+			hc.Timeout = timeout
+		case "query":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return c.ArgErr()
+			}
+			if _, ok := dns.IsDomainName(args[0]); !ok {
+				return fmt.Errorf("health_check: invalid query name %s", args[0])
+			}
+			qtype, ok := dns.StringToType[strings.ToUpper(args[1])]
+			if !ok {
+				return fmt.Errorf("health_check: invalid query type %s", args[1])
+			}
+			hc.QName, hc.QType = plugin.Name(args[0]).Normalize(), qtype
+		case "expect":
+			hc.Expect = c.RemainingArgs()
+			if len(hc.Expect) == 0 {
+				return c.ArgErr()
+			}
+			if slices.Contains(hc.Expect, expectAny) && len(hc.Expect) > 1 {
+				return fmt.Errorf("health_check: expect %s can not be combined with values", expectAny)
+			}
+		case "rise", "fall":
+			name := c.Val()
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 {
+				return fmt.Errorf("health_check: invalid %s %s, must be a positive number", name, c.Val())
+			}
+			if name == "rise" {
+				hc.Rise = n
+			} else {
+				hc.Fall = n
+			}
+		default:
+			return c.Errf("health_check: unknown parameter: %s", c.Val())
+		}
+	}
+
+	return nil
+}
+
+// parseOutlierDetection parses `outlier_detection [{ consecutive_errors ..., error_ratio ..., ... }]`
+func parseOutlierDetection(c *caddy.Controller) (*OutlierConfig, error) {
+	outlier := &OutlierConfig{
+		ConsecutiveErrors:  defaultConsecutiveErrors,
+		MinRequests:        defaultOutlierMinRequests,
+		Interval:           defaultOutlierInterval,
+		BaseEjectionTime:   defaultBaseEjectionTime,
+		MaxEjectionTime:    defaultMaxEjectionTime,
+		MaxEjectionPercent: defaultMaxEjectionPercent,
+	}
+
+	if !c.NextArg() {
+		return outlier, nil
+	}
+	if c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		name := c.Val()
+		switch name {
+		case "consecutive_errors", "max_ejection_percent":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 0 || (name == "max_ejection_percent" && n > 100) {
+				return nil, fmt.Errorf("outlier_detection: invalid %s %s", name, c.Val())
+			}
+			if name == "consecutive_errors" {
+				outlier.ConsecutiveErrors = n
+			} else {
+				outlier.MaxEjectionPercent = n
+			}
+		case "error_ratio":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			ratio, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				return nil, fmt.Errorf("outlier_detection: invalid error_ratio %s, must be between 0 and 1", args[0])
+			}
+			outlier.ErrorRatio = ratio
+			if len(args) == 2 {
+				minRequests, err := strconv.Atoi(args[1])
+				if err != nil || minRequests < 1 {
+					return nil, fmt.Errorf("outlier_detection: invalid error_ratio min requests %s", args[1])
+				}
+				outlier.MinRequests = minRequests
+			}
+		case "interval", "base_ejection_time", "max_ejection_time":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("outlier_detection: invalid %s %s", name, c.Val())
+			}
+			switch name {
+			case "interval":
+				outlier.Interval = duration
+			case "base_ejection_time":
+				outlier.BaseEjectionTime = duration
+			default:
+				outlier.MaxEjectionTime = duration
+			}
+		default:
+			return nil, c.Errf("outlier_detection: unknown parameter: %s", name)
+		}
+	}
+
+	return outlier, nil
+}
+
+// parseAdaptiveTimeout parses `upstream_read_timeout adaptive [{ percentile P, factor F, min DURATION, max DURATION, samples N }]`
+func parseAdaptiveTimeout(c *caddy.Controller) (*AdaptiveTimeoutConfig, error) {
+	adaptive := &AdaptiveTimeoutConfig{
+		Percentile: defaultAdaptivePercentile,
+		Factor:     defaultAdaptiveFactor,
+		Min:        defaultAdaptiveMin,
+		Max:        defaultAdaptiveMax,
+		Samples:    defaultAdaptiveSamples,
+	}
+
+	if !c.NextArg() {
+		return adaptive, nil
+	}
+	if c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		name := c.Val()
+		if !c.NextArg() {
+			return nil, c.ArgErr()
+		}
+		switch name {
+		case "percentile":
+			percentile, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || percentile <= 0 || percentile > 100 {
+				return nil, fmt.Errorf("upstream_read_timeout: invalid percentile %s, must be greater than 0 and at most 100", c.Val())
+			}
+			adaptive.Percentile = percentile
+		case "factor":
+			factor, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || factor < 1 {
+				return nil, fmt.Errorf("upstream_read_timeout: invalid factor %s, must be at least 1", c.Val())
+			}
+			adaptive.Factor = factor
+		case "min", "max":
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("upstream_read_timeout: invalid %s %s", name, c.Val())
+			}
+			if name == "min" {
+				adaptive.Min = duration
+			} else {
+				adaptive.Max = duration
+			}
+		case "samples":
+			samples, err := strconv.Atoi(c.Val())
+			if err != nil || samples < adaptiveMinSamples {
+				return nil, fmt.Errorf("upstream_read_timeout: invalid samples %s, must be at least %d", c.Val(), adaptiveMinSamples)
+			}
+			adaptive.Samples = samples
+		default:
+			return nil, c.Errf("upstream_read_timeout: unknown parameter: %s", name)
+		}
+	}
+	if adaptive.Min > adaptive.Max {
+		return nil, fmt.Errorf("upstream_read_timeout: min %v is greater than max %v", adaptive.Min, adaptive.Max)
+	}
+
+	return adaptive, nil
+}
+
+// parseSlowStart parses `slow_start DURATION [aggression FACTOR] [min_weight PERCENT]`
+func parseSlowStart(c *caddy.Controller) (*SlowStartConfig, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args)%2 == 0 {
+		return nil, c.ArgErr()
+	}
+	window, err := time.ParseDuration(args[0])
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("slow_start: invalid duration %s", args[0])
+	}
+	slowStart := &SlowStartConfig{Window: window, Aggression: defaultSlowStartAggression, MinWeight: defaultSlowStartMinWeight}
+
+	for i := 1; i < len(args); i += 2 {
+		value, err := strconv.ParseFloat(args[i+1], 64)
+		switch args[i] {
+		case "aggression":
+			if err != nil || value <= 0 {
+				return nil, fmt.Errorf("slow_start: invalid aggression %s, must be greater than 0", args[i+1])
+			}
+			slowStart.Aggression = value
+		case "min_weight":
+			if err != nil || value <= 0 || value > 100 {
+				return nil, fmt.Errorf("slow_start: invalid min_weight %s, must be greater than 0 and at most 100", args[i+1])
+			}
+			slowStart.MinWeight = value / 100
+		default:
+			return nil, fmt.Errorf("slow_start: unknown parameter: %s", args[i])
+		}
+	}
+
+	return slowStart, nil
+}
+
+// parseRetry parses `retry [{ on ..., attempts N, per_try_timeout DURATION, budget RATIO }]`
+func parseRetry(c *caddy.Controller) (*RetryConfig, error) {
+	retry := &RetryConfig{
+		Rcodes:   []int{dns.RcodeServerFailure},
+		Timeout:  true,
+		Attempts: defaultRetryAttempts,
+		Budget:   defaultRetryBudget,
+	}
+
+	if !c.NextArg() {
+		return retry, nil
+	}
+	if c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		switch c.Val() {
+		case "on":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			retry.Rcodes, retry.Timeout = nil, false
+			for _, arg := range args {
+				if arg == retryTimeout {
+					retry.Timeout = true
+					continue
+				}
+				rcode, ok := dns.StringToRcode[strings.ToUpper(arg)]
+				if !ok || rcode == dns.RcodeSuccess {
+					return nil, fmt.Errorf("retry: unknown condition %s", arg)
+				}
+				retry.Rcodes = append(retry.Rcodes, rcode)
+			}
+		case "attempts":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			attempts, err := strconv.Atoi(c.Val())
+			if err != nil || attempts < 2 {
+				return nil, fmt.Errorf("retry: invalid attempts %s, must be at least 2", c.Val())
+			}
+			retry.Attempts = attempts
+		case "per_try_timeout":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			timeout, err := time.ParseDuration(c.Val())
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("retry: invalid per_try_timeout %s", c.Val())
+			}
+			retry.PerTryTimeout = timeout
+		case "budget":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			budget, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || budget <= 0 || budget > 1 {
+				return nil, fmt.Errorf("retry: invalid budget %s, must be greater than 0 and at most 1", c.Val())
+			}
+			retry.Budget = budget
+		default:
+			return nil, c.Errf("retry: unknown parameter: %s", c.Val())
+		}
+	}
+
+	return retry, nil
+}
+
+// parseRateLimit parses `ratelimit { global QPS [BURST], client QPS [BURST], action ..., allow CIDR..., max_clients N }`
+func parseRateLimit(c *caddy.Controller) (*RateLimitConfig, error) {
+	rateLimit := &RateLimitConfig{Action: rateLimitRefuse, MaxClients: defaultRateLimitMaxClients}
+
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.Errf("ratelimit: expected block")
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		name := c.Val()
+		switch name {
+		case "global", "client":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			qps, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || qps <= 0 {
+				return nil, fmt.Errorf("ratelimit: invalid %s QPS %s", name, args[0])
+			}
+			// Burst defaults to one second worth of queries
+			burst := max(int(qps), 1)
+			if len(args) == 2 {
+				if burst, err = strconv.Atoi(args[1]); err != nil || burst < 1 {
+					return nil, fmt.Errorf("ratelimit: invalid %s burst %s", name, args[1])
+				}
+			}
+			if name == "global" {
+				rateLimit.GlobalQPS, rateLimit.GlobalBurst = qps, burst
+			} else {
+				rateLimit.ClientQPS, rateLimit.ClientBurst = qps, burst
+			}
+		case "action":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch c.Val() {
+			case rateLimitRefuse, rateLimitDrop:
+				rateLimit.Action = c.Val()
+			default:
+				return nil, fmt.Errorf("ratelimit: unknown action %s", c.Val())
+			}
+		case "allow":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, arg := range args {
+				prefix, err := parsePrefix(arg)
+				if err != nil {
+					return nil, fmt.Errorf("ratelimit: invalid allow %s: %v", arg, err)
+				}
+				rateLimit.Allow = append(rateLimit.Allow, prefix)
+			}
+		case "max_clients":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("ratelimit: invalid max_clients %s", c.Val())
+			}
+			rateLimit.MaxClients = n
+		default:
+			return nil, c.Errf("ratelimit: unknown parameter: %s", name)
+		}
+	}
+
+	if rateLimit.GlobalQPS == 0 && rateLimit.ClientQPS == 0 {
+		return nil, fmt.Errorf("ratelimit: global or client limit is required")
+	}
+
+	return rateLimit, nil
+}
+
+// parseMaxInflight parses `max_inflight { global N, per_upstream N, queue SIZE [TIMEOUT], reply servfail|refused }`
+func parseMaxInflight(c *caddy.Controller) (*MaxInflightConfig, error) {
+	maxInflight := &MaxInflightConfig{QueueTimeout: defaultQueueTimeout, Rcode: dns.RcodeServerFailure}
+
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.Errf("max_inflight: expected block")
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		name := c.Val()
+		switch name {
+		case "global", "per_upstream":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("max_inflight: invalid %s %s", name, c.Val())
+			}
+			if name == "global" {
+				maxInflight.Global = n
+			} else {
+				maxInflight.PerUpstream = n
+			}
+		case "queue":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			size, err := strconv.Atoi(args[0])
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("max_inflight: invalid queue size %s", args[0])
+			}
+			maxInflight.QueueSize = size
+			if len(args) == 2 {
+				timeout, err := time.ParseDuration(args[1])
+				if err != nil || timeout <= 0 {
+					return nil, fmt.Errorf("max_inflight: invalid queue timeout %s", args[1])
+				}
+				maxInflight.QueueTimeout = timeout
+			}
+		case "reply":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch strings.ToLower(c.Val()) {
+			case "servfail":
+				maxInflight.Rcode = dns.RcodeServerFailure
+			case "refused":
+				maxInflight.Rcode = dns.RcodeRefused
+			default:
+				return nil, fmt.Errorf("max_inflight: unknown reply %s", c.Val())
+			}
+		default:
+			return nil, c.Errf("max_inflight: unknown parameter: %s", name)
+		}
+	}
+
+	if maxInflight.Global == 0 && maxInflight.PerUpstream == 0 {
+		return nil, fmt.Errorf("max_inflight: global or per_upstream limit is required")
+	}
+
+	return maxInflight, nil
+}
+
+// parsePrefix parses CIDR or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
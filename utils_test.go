@@ -1,21 +1,26 @@
 package kubeforward
 
 import (
+	"net/netip"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/miekg/dns"
 )
 
 func TestParseConfig(t *testing.T) {
 	tests := []struct {
-		name          string
-		input         string
-		expected      KubeForwardConfig
-		expectErr     bool
-		expectedError string
+		name           string
+		input          string
+		expected       KubeForwardConfig
+		expectedRoutes []RouteConfig
+		expectErr      bool
+		expectedError  string
 	}{
 		{
 			name: "Valid config with all supported parameters",
@@ -29,15 +34,17 @@ func TestParseConfig(t *testing.T) {
 				prefer_udp
 				slow_threshold 200ms
 				slow_log
+				coalesce
 			}`,
 			expected: KubeForwardConfig{
 				Namespace:           "kube-system",
 				ServiceName:         "d8-kube-dns",
-				PortName:            "dns",
+				PortNames:           []string{"dns"},
 				Expire:              10 * time.Minute,
 				UpstreamReadTimeout: 5 * time.Second,
 				SlowThreshold:       200 * time.Millisecond,
 				SlowLogEnabled:      true,
+				Coalesce:            true,
 				opts: proxy.Options{
 					PreferUDP:          true,
 					HCRecursionDesired: false,
@@ -79,42 +86,992 @@ func TestParseConfig(t *testing.T) {
 			expectedError: "Wrong argument count or unexpected line ending after 'health_check'",
 		},
 		{
-			name: "Config with unsupported health_check duration",
+			name: "Config with health_check interval",
 			input: `kubeforward {
 				namespace kube-system
 				service_name d8-kube-dns
 				port_name dns
-				health_check 500ms
+				health_check 2s no_rec
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				HealthCheck: &HealthCheckConfig{
+					Interval: 2 * time.Second,
+					Timeout:  time.Second,
+					QName:    ".",
+					QType:    dns.TypeNS,
+					Rise:     2,
+					Fall:     3,
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: false,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with health_check block",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				health_check 1s {
+					timeout 300ms
+					query kubernetes.default.svc.cluster.local A
+					expect 10.96.0.1
+					rise 1
+					fall 2
+				}
+				prefer_udp
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				HealthCheck: &HealthCheckConfig{
+					Interval: time.Second,
+					Timeout:  300 * time.Millisecond,
+					QName:    "kubernetes.default.svc.cluster.local.",
+					QType:    dns.TypeA,
+					Expect:   []string{"10.96.0.1"},
+					Rise:     1,
+					Fall:     2,
+				},
+				opts: proxy.Options{
+					PreferUDP:          true,
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with health_check block without interval",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				health_check domain example.org {
+					expect any
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				HealthCheck: &HealthCheckConfig{
+					Interval: 500 * time.Millisecond,
+					Timeout:  time.Second,
+					QName:    "example.org.",
+					QType:    dns.TypeNS,
+					Expect:   []string{"any"},
+					Rise:     2,
+					Fall:     3,
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           "example.org.",
+				},
+			},
+		},
+		{
+			name: "Config with invalid health_check query type",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				health_check {
+					query example.org BOGUS
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "health_check: invalid query type BOGUS",
+		},
+		{
+			name: "Config with invalid health_check rise",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				health_check {
+					rise 0
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "health_check: invalid rise 0, must be a positive number",
+		},
+		{
+			name: "Config with unknown health_check parameter",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				health_check {
+					protocol udp
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "health_check: unknown parameter: protocol",
+		},
+		{
+			name: "Config with outlier_detection",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				outlier_detection {
+					consecutive_errors 3
+					error_ratio 0.3 50
+					interval 5s
+					base_ejection_time 10s
+					max_ejection_time 1m
+					max_ejection_percent 30
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				OutlierDetection: &OutlierConfig{
+					ConsecutiveErrors:  3,
+					ErrorRatio:         0.3,
+					MinRequests:        50,
+					Interval:           5 * time.Second,
+					BaseEjectionTime:   10 * time.Second,
+					MaxEjectionTime:    time.Minute,
+					MaxEjectionPercent: 30,
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with default outlier_detection",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				outlier_detection
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				OutlierDetection: &OutlierConfig{
+					ConsecutiveErrors:  5,
+					MinRequests:        20,
+					Interval:           10 * time.Second,
+					BaseEjectionTime:   30 * time.Second,
+					MaxEjectionTime:    300 * time.Second,
+					MaxEjectionPercent: 50,
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with invalid outlier_detection error_ratio",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				outlier_detection {
+					error_ratio 1.5
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "outlier_detection: invalid error_ratio 1.5, must be between 0 and 1",
+		},
+		{
+			name: "Config with invalid outlier_detection max_ejection_percent",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				outlier_detection {
+					max_ejection_percent 120
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "outlier_detection: invalid max_ejection_percent 120",
+		},
+		{
+			name: "Config with ratelimit",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				ratelimit {
+					global 5000
+					client 100 200
+					action drop
+					allow 10.0.0.0/8 192.168.1.1
+					max_clients 500
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				RateLimit: &RateLimitConfig{
+					GlobalQPS:   5000,
+					GlobalBurst: 5000,
+					ClientQPS:   100,
+					ClientBurst: 200,
+					Action:      "drop",
+					Allow:       []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.1/32")},
+					MaxClients:  500,
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with ratelimit without limits",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				ratelimit {
+					action refuse
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "ratelimit: global or client limit is required",
+		},
+		{
+			name: "Config with invalid ratelimit action",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				ratelimit {
+					client 10
+					action truncate
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "ratelimit: unknown action truncate",
+		},
+		{
+			name: "Config with max_inflight",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				max_inflight {
+					global 1000
+					per_upstream 200
+					queue 100 50ms
+					reply refused
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				MaxInflight: &MaxInflightConfig{
+					Global:       1000,
+					PerUpstream:  200,
+					QueueSize:    100,
+					QueueTimeout: 50 * time.Millisecond,
+					Rcode:        dns.RcodeRefused,
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with invalid max_inflight global",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				max_inflight {
+					global 0
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "max_inflight: invalid global 0",
+		},
+		{
+			name: "Config with emergency",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				emergency cluster.example ttl 30
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				Emergency:           &EmergencyConfig{Zone: "cluster.example.", TTL: 30},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with default emergency",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				emergency
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				Emergency:           &EmergencyConfig{Zone: "cluster.local.", TTL: 5},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with invalid emergency ttl",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				emergency ttl 0
+			}`,
+			expectErr:     true,
+			expectedError: "emergency: invalid ttl 0, must be in range 1-3600",
+		},
+		{
+			name: "Config with emergency_upstreams",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				emergency_upstreams 10.0.0.1 10.0.0.2:5353 cluster_zones cluster.example in-addr.arpa
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				EmergencyUpstreams: &EmergencyUpstreamsConfig{
+					To:           []string{"10.0.0.1:53", "10.0.0.2:5353"},
+					ClusterZones: []string{"cluster.example.", "in-addr.arpa."},
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with emergency_upstreams and emergency zone",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				emergency cluster.example
+				emergency_upstreams 10.0.0.1
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				Emergency:           &EmergencyConfig{Zone: "cluster.example.", TTL: 5},
+				EmergencyUpstreams: &EmergencyUpstreamsConfig{
+					To:           []string{"10.0.0.1:53"},
+					ClusterZones: []string{"cluster.example."},
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with emergency_upstreams over TLS",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				emergency_upstreams tls://10.0.0.1
+			}`,
+			expectErr:     true,
+			expectedError: "emergency_upstreams: only plain DNS is supported: tls://10.0.0.1:853",
+		},
+		{
+			name: "Config with invalid emergency_upstreams",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				emergency_upstreams /nonexistent/resolv.conf
+			}`,
+			expectErr:     true,
+			expectedError: "emergency_upstreams: not an IP address or file",
+		},
+		{
+			name: "Config with retry",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				retry {
+					on servfail REFUSED timeout
+					attempts 3
+					per_try_timeout 500ms
+					budget 0.1
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 500 * time.Millisecond,
+				Retry: &RetryConfig{
+					Rcodes:        []int{dns.RcodeServerFailure, dns.RcodeRefused},
+					Timeout:       true,
+					Attempts:      3,
+					PerTryTimeout: 500 * time.Millisecond,
+					Budget:        0.1,
+				},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with default retry",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				retry
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				Retry:               &RetryConfig{Rcodes: []int{dns.RcodeServerFailure}, Timeout: true, Attempts: 2, Budget: 0.2},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with invalid retry condition",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				retry {
+					on noerror
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "retry: unknown condition noerror",
+		},
+		{
+			name: "Config with invalid retry attempts",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				retry {
+					attempts 1
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "retry: invalid attempts 1, must be at least 2",
+		},
+		{
+			name: "Config with adaptive upstream_read_timeout",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				upstream_read_timeout adaptive {
+					percentile 95
+					factor 3
+					min 50ms
+					max 2s
+					samples 500
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 2 * time.Second,
+				AdaptiveTimeout:     &AdaptiveTimeoutConfig{Percentile: 95, Factor: 3, Min: 50 * time.Millisecond, Max: 2 * time.Second, Samples: 500},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with default adaptive upstream_read_timeout",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				upstream_read_timeout adaptive
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 5 * time.Second,
+				AdaptiveTimeout:     &AdaptiveTimeoutConfig{Percentile: 99, Factor: 2, Min: 100 * time.Millisecond, Max: 5 * time.Second, Samples: 200},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with adaptive upstream_read_timeout min over max",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				upstream_read_timeout adaptive {
+					min 10s
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "upstream_read_timeout: min 10s is greater than max 5s",
+		},
+		{
+			name: "Config with subset_size",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				subset_size 3
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				SubsetSize:          3,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with invalid subset_size",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				subset_size 0
+			}`,
+			expectErr:     true,
+			expectedError: "subset_size: invalid size 0",
+		},
+		{
+			name: "Config with slow_start",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				slow_start 30s aggression 2 min_weight 5
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				SlowStart:           &SlowStartConfig{Window: 30 * time.Second, Aggression: 2, MinWeight: 0.05},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with default slow_start",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				slow_start 1m
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				SlowStart:           &SlowStartConfig{Window: time.Minute, Aggression: 1, MinWeight: 0.1},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+		},
+		{
+			name: "Config with invalid slow_start aggression",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				slow_start 1m aggression 0
+			}`,
+			expectErr:     true,
+			expectedError: "slow_start: invalid aggression 0, must be greater than 0",
+		},
+		{
+			name: "Config with invalid health_check domain",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				health_check domain example..org
+			}`,
+			expectErr:     true,
+			expectedError: "health_check: invalid domain name",
+		},
+		{
+			name: "Minimal valid config",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				SlowThreshold:       0,
+				SlowLogEnabled:      false,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with separate UDP and TCP port names",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns dns-tcp
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns", "dns-tcp"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with tls and per-endpoint tls_servername",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns-tls
+				tls
+				tls_servername {hostname}.d8-kube-dns.kube-system.svc
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns-tls"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				Transport:           "tls",
+				TLSServerName:       "{hostname}.d8-kube-dns.kube-system.svc",
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with tls_servername without tls",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				tls_servername dns.example.org
+			}`,
+			expectErr:     true,
+			expectedError: "tls_servername requires tls",
+		},
+		{
+			name: "Config with routes",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				route corp.example {
+					namespace corp-dns
+					service_name resolver
+					port_name dns dns-tcp
+				}
+				route cluster.local 10.0.0.0/8 {
+					namespace kube-system
+					service_name coredns
+					port_name dns
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectedRoutes: []RouteConfig{
+				{Zones: []string{"corp.example."}, Namespace: "corp-dns", ServiceName: "resolver", PortNames: []string{"dns", "dns-tcp"}},
+				{Zones: []string{"cluster.local.", "10.in-addr.arpa."}, Namespace: "kube-system", ServiceName: "coredns", PortNames: []string{"dns"}},
+				{Zones: []string{"."}, Namespace: "kube-system", ServiceName: "d8-kube-dns", PortNames: []string{"dns"}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with only routes",
+			input: `kubeforward {
+				route cluster.local {
+					namespace kube-system
+					service_name coredns
+					port_name dns
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectedRoutes: []RouteConfig{
+				{Zones: []string{"cluster.local."}, Namespace: "kube-system", ServiceName: "coredns", PortNames: []string{"dns"}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with incomplete route",
+			input: `kubeforward {
+				route cluster.local {
+					namespace kube-system
+					port_name dns
+				}
 			}`,
 			expectErr:     true,
-			expectedError: "health_check duration is not supported by kubeforward; use upstream_read_timeout",
+			expectedError: "route [cluster.local.]: namespace, servicename, and portname are required parameters",
 		},
 		{
-			name: "Config with invalid health_check domain",
+			name: "Config with direct routes",
+			input: `kubeforward {
+				route cluster.local in-addr.arpa {
+					namespace kube-system
+					service_name coredns
+					port_name dns
+				}
+				direct . {
+					to 10.0.0.1 10.0.0.2:5353
+				}
+				direct corp.example {
+					namespace corp-dns
+					service_name resolver
+					port_name dns
+				}
+			}`,
+			expected: KubeForwardConfig{
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectedRoutes: []RouteConfig{
+				{Zones: []string{"cluster.local.", "in-addr.arpa."}, Namespace: "kube-system", ServiceName: "coredns", PortNames: []string{"dns"}},
+				{Zones: []string{"."}, Direct: true, To: []string{"10.0.0.1:53", "10.0.0.2:5353"}},
+				{Zones: []string{"corp.example."}, Namespace: "corp-dns", ServiceName: "resolver", PortNames: []string{"dns"}, Direct: true},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with direct zone of the top level Service",
 			input: `kubeforward {
 				namespace kube-system
 				service_name d8-kube-dns
 				port_name dns
-				health_check domain example..org
+				direct . {
+					to 10.0.0.1
+				}
 			}`,
 			expectErr:     true,
-			expectedError: "health_check: invalid domain name",
+			expectedError: "zone . is served by more than one route",
 		},
 		{
-			name: "Minimal valid config",
+			name: "Config with direct to and Service",
+			input: `kubeforward {
+				direct example.org {
+					to 10.0.0.1
+					namespace corp-dns
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "direct [example.org.]: either to or a Service can be given",
+		},
+		{
+			name: "Config with route to",
+			input: `kubeforward {
+				route example.org {
+					to 10.0.0.1
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "route: unknown parameter: to",
+		},
+		{
+			name: "Config with direct over TLS",
+			input: `kubeforward {
+				direct example.org {
+					to tls://10.0.0.1
+				}
+			}`,
+			expectErr:     true,
+			expectedError: "direct [example.org.]: only plain DNS is supported: tls://10.0.0.1:853",
+		},
+		{
+			name: "Config with except and fallthrough_on",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				except example.org 192.168.0.0/16
+				fallthrough_on servfail REFUSED no_upstreams
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:              "kube-system",
+				ServiceName:            "d8-kube-dns",
+				PortNames:              []string{"dns"},
+				Expire:                 10 * time.Second,
+				UpstreamReadTimeout:    300 * time.Second,
+				Except:                 []string{"example.org.", "168.192.in-addr.arpa."},
+				FallthroughRcodes:      []int{dns.RcodeServerFailure, dns.RcodeRefused},
+				FallthroughNoUpstreams: true,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with unknown fallthrough_on rcode",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				fallthrough_on NOPE
+			}`,
+			expectErr:     true,
+			expectedError: "fallthrough_on: unknown rcode NOPE",
+		},
+		{
+			name: "Config with client_identity ecs",
 			input: `kubeforward {
 				namespace kube-system
 				service_name d8-kube-dns
 				port_name dns
+				client_identity ecs 24 56
 			}`,
 			expected: KubeForwardConfig{
 				Namespace:           "kube-system",
 				ServiceName:         "d8-kube-dns",
-				PortName:            "dns",
+				PortNames:           []string{"dns"},
 				Expire:              10 * time.Second,
 				UpstreamReadTimeout: 300 * time.Second,
-				SlowThreshold:       0,
-				SlowLogEnabled:      false,
+				clientIdentity:      &clientIdentity{mode: "ecs", prefix4: 24, prefix6: 56},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with client_identity local",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				client_identity local 0xffee
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				clientIdentity:      &clientIdentity{mode: "local", prefix4: 32, prefix6: 128, code: 0xffee},
 				opts: proxy.Options{
 					HCRecursionDesired: true,
 					HCDomain:           ".",
@@ -122,6 +1079,17 @@ func TestParseConfig(t *testing.T) {
 			},
 			expectErr: false,
 		},
+		{
+			name: "Config with client_identity local code out of range",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				client_identity local 8
+			}`,
+			expectErr:     true,
+			expectedError: "client_identity: invalid local option code 8",
+		},
 		{
 			name: "Config with force_tcp",
 			input: `kubeforward {
@@ -133,7 +1101,7 @@ func TestParseConfig(t *testing.T) {
 			expected: KubeForwardConfig{
 				Namespace:           "kube-system",
 				ServiceName:         "d8-kube-dns",
-				PortName:            "dns",
+				PortNames:           []string{"dns"},
 				Expire:              10 * time.Second,
 				UpstreamReadTimeout: 300 * time.Second,
 				opts: proxy.Options{
@@ -144,6 +1112,187 @@ func TestParseConfig(t *testing.T) {
 			},
 			expectErr: false,
 		},
+		{
+			name: "Config with debug_listen",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				debug_listen 127.0.0.1:9154
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				DebugListen:         "127.0.0.1:9154",
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with invalid debug_listen",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				debug_listen 9154
+			}`,
+			expectErr:     true,
+			expectedError: "invalid debug_listen address",
+		},
+		{
+			name: "Config with chaos ACL",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				chaos 10.0.0.0/8 fd00::1
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				ChaosACL:            []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::1/128")},
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with invalid chaos ACL",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				chaos 10.0.0.0/33
+			}`,
+			expectErr:     true,
+			expectedError: "chaos: netip.ParsePrefix",
+		},
+		{
+			name: "Config with events",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				events node
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				Events:              "node",
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with unknown events object",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				events deployment
+			}`,
+			expectErr:     true,
+			expectedError: "events: unknown object deployment",
+		},
+		{
+			name: "Config with otlp",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				otlp otel-collector:4317 insecure sample 0.1
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				OTLPEndpoint:        "otel-collector:4317",
+				OTLPInsecure:        true,
+				OTLPSampleRatio:     0.1,
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with invalid otlp sample ratio",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				otlp otel-collector:4317 sample 2
+			}`,
+			expectErr:     true,
+			expectedError: "otlp: invalid sample ratio 2",
+		},
+		{
+			name: "Config with log levels and format",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				log_level warning
+				log_level discovery debug
+				log_format json
+			}`,
+			expected: KubeForwardConfig{
+				Namespace:           "kube-system",
+				ServiceName:         "d8-kube-dns",
+				PortNames:           []string{"dns"},
+				Expire:              10 * time.Second,
+				UpstreamReadTimeout: 300 * time.Second,
+				LogLevels:           map[string]string{"": "warning", "discovery": "debug"},
+				LogFormat:           "json",
+				opts: proxy.Options{
+					HCRecursionDesired: true,
+					HCDomain:           ".",
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Config with unknown log subsystem",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				log_level watcher debug
+			}`,
+			expectErr:     true,
+			expectedError: "log_level: unknown subsystem watcher",
+		},
+		{
+			name: "Config with unknown log level",
+			input: `kubeforward {
+				namespace kube-system
+				service_name d8-kube-dns
+				port_name dns
+				log_level verbose
+			}`,
+			expectErr:     true,
+			expectedError: "log_level: unknown level verbose",
+		},
 	}
 
 	for _, test := range tests {
@@ -172,8 +1321,8 @@ func TestParseConfig(t *testing.T) {
 			if config.ServiceName != test.expected.ServiceName {
 				t.Errorf("expected service_name %q, got %q", test.expected.ServiceName, config.ServiceName)
 			}
-			if config.PortName != test.expected.PortName {
-				t.Errorf("expected port_name %q, got %q", test.expected.PortName, config.PortName)
+			if !slices.Equal(config.PortNames, test.expected.PortNames) {
+				t.Errorf("expected port_name %v, got %v", test.expected.PortNames, config.PortNames)
 			}
 			if config.Expire != test.expected.Expire {
 				t.Errorf("expected expire %v, got %v", test.expected.Expire, config.Expire)
@@ -187,18 +1336,91 @@ func TestParseConfig(t *testing.T) {
 			if config.SlowLogEnabled != test.expected.SlowLogEnabled {
 				t.Errorf("expected slow_log %v, got %v", test.expected.SlowLogEnabled, config.SlowLogEnabled)
 			}
+			expectedTransport := test.expected.Transport
+			if expectedTransport == "" {
+				expectedTransport = "dns"
+			}
+			if config.Transport != expectedTransport {
+				t.Errorf("expected transport %q, got %q", expectedTransport, config.Transport)
+			}
+			if config.TLSServerName != test.expected.TLSServerName {
+				t.Errorf("expected tls_servername %q, got %q", test.expected.TLSServerName, config.TLSServerName)
+			}
 			if config.opts.HCRecursionDesired != test.expected.opts.HCRecursionDesired {
 				t.Errorf("expected health_check recursion_desired %v, got %v", test.expected.opts.HCRecursionDesired, config.opts.HCRecursionDesired)
 			}
 			if config.opts.HCDomain != test.expected.opts.HCDomain {
 				t.Errorf("expected health_check domain %q, got %q", test.expected.opts.HCDomain, config.opts.HCDomain)
 			}
+			if !reflect.DeepEqual(config.HealthCheck, test.expected.HealthCheck) {
+				t.Errorf("expected health_check %+v, got %+v", test.expected.HealthCheck, config.HealthCheck)
+			}
+			if !reflect.DeepEqual(config.OutlierDetection, test.expected.OutlierDetection) {
+				t.Errorf("expected outlier_detection %+v, got %+v", test.expected.OutlierDetection, config.OutlierDetection)
+			}
+			if !reflect.DeepEqual(config.RateLimit, test.expected.RateLimit) {
+				t.Errorf("expected ratelimit %+v, got %+v", test.expected.RateLimit, config.RateLimit)
+			}
+			if !reflect.DeepEqual(config.MaxInflight, test.expected.MaxInflight) {
+				t.Errorf("expected max_inflight %+v, got %+v", test.expected.MaxInflight, config.MaxInflight)
+			}
+			if config.Coalesce != test.expected.Coalesce {
+				t.Errorf("expected coalesce %v, got %v", test.expected.Coalesce, config.Coalesce)
+			}
+			if !reflect.DeepEqual(config.Emergency, test.expected.Emergency) {
+				t.Errorf("expected emergency %+v, got %+v", test.expected.Emergency, config.Emergency)
+			}
+			if !reflect.DeepEqual(config.SlowStart, test.expected.SlowStart) {
+				t.Errorf("expected slow_start %+v, got %+v", test.expected.SlowStart, config.SlowStart)
+			}
+			if config.SubsetSize != test.expected.SubsetSize {
+				t.Errorf("expected subset_size %d, got %d", test.expected.SubsetSize, config.SubsetSize)
+			}
+			if !reflect.DeepEqual(config.AdaptiveTimeout, test.expected.AdaptiveTimeout) {
+				t.Errorf("expected adaptive timeout %+v, got %+v", test.expected.AdaptiveTimeout, config.AdaptiveTimeout)
+			}
+			if !reflect.DeepEqual(config.Retry, test.expected.Retry) {
+				t.Errorf("expected retry %+v, got %+v", test.expected.Retry, config.Retry)
+			}
+			if !reflect.DeepEqual(config.EmergencyUpstreams, test.expected.EmergencyUpstreams) {
+				t.Errorf("expected emergency_upstreams %+v, got %+v", test.expected.EmergencyUpstreams, config.EmergencyUpstreams)
+			}
 			if config.opts.ForceTCP != test.expected.opts.ForceTCP {
 				t.Errorf("expected force_tcp %v, got %v", test.expected.opts.ForceTCP, config.opts.ForceTCP)
 			}
 			if config.opts.PreferUDP != test.expected.opts.PreferUDP {
 				t.Errorf("expected prefer_udp %v, got %v", test.expected.opts.PreferUDP, config.opts.PreferUDP)
 			}
+			if !slices.Equal(config.Except, test.expected.Except) {
+				t.Errorf("expected except %v, got %v", test.expected.Except, config.Except)
+			}
+			if !slices.Equal(config.FallthroughRcodes, test.expected.FallthroughRcodes) {
+				t.Errorf("expected fallthrough_on rcodes %v, got %v", test.expected.FallthroughRcodes, config.FallthroughRcodes)
+			}
+			if config.FallthroughNoUpstreams != test.expected.FallthroughNoUpstreams {
+				t.Errorf("expected fallthrough_on no_upstreams %v, got %v", test.expected.FallthroughNoUpstreams, config.FallthroughNoUpstreams)
+			}
+			if config.DebugListen != test.expected.DebugListen {
+				t.Errorf("expected debug_listen %q, got %q", test.expected.DebugListen, config.DebugListen)
+			}
+			if config.OTLPEndpoint != test.expected.OTLPEndpoint || config.OTLPInsecure != test.expected.OTLPInsecure || config.OTLPSampleRatio != test.expected.OTLPSampleRatio {
+				t.Errorf("expected otlp %q insecure=%v sample=%v, got %q insecure=%v sample=%v", test.expected.OTLPEndpoint, test.expected.OTLPInsecure, test.expected.OTLPSampleRatio, config.OTLPEndpoint, config.OTLPInsecure, config.OTLPSampleRatio)
+			}
+			if !reflect.DeepEqual(config.LogLevels, test.expected.LogLevels) || config.LogFormat != test.expected.LogFormat {
+				t.Errorf("expected log_level %v log_format %q, got %v %q", test.expected.LogLevels, test.expected.LogFormat, config.LogLevels, config.LogFormat)
+			}
+			if config.Events != test.expected.Events {
+				t.Errorf("expected events %q, got %q", test.expected.Events, config.Events)
+			}
+			if !slices.Equal(config.ChaosACL, test.expected.ChaosACL) {
+				t.Errorf("expected chaos %v, got %v", test.expected.ChaosACL, config.ChaosACL)
+			}
+			if !reflect.DeepEqual(config.clientIdentity, test.expected.clientIdentity) {
+				t.Errorf("expected client_identity %+v, got %+v", test.expected.clientIdentity, config.clientIdentity)
+			}
+			if test.expectedRoutes != nil && !reflect.DeepEqual(config.Routes, test.expectedRoutes) {
+				t.Errorf("expected routes %+v, got %+v", test.expectedRoutes, config.Routes)
+			}
 		})
 	}
 }
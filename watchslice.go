@@ -3,27 +3,70 @@ package kubeforward
 import (
 	"context"
 	"fmt"
-	"log"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
 
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
 
+// upstreamEndpoint is one discovered upstream address with the endpoint it belongs to.
+type upstreamEndpoint struct {
+	Addr        string
+	Hostname    string
+	Pod         string
+	NodeName    string
+	Zone        string
+	AppProtocol string
+}
+
+// upstreamAddrs holds the discovered upstream addresses split by transport.
+type upstreamAddrs struct {
+	UDP []upstreamEndpoint
+	TCP []upstreamEndpoint
+}
+
+// statusListWatch reports the result of every List and Watch call to onStatus
+type statusListWatch struct {
+	cache.ListerWatcher
+	onStatus func(err error)
+}
+
+func (lw *statusListWatch) List(options metav1.ListOptions) (runtime.Object, error) {
+	obj, err := lw.ListerWatcher.List(options)
+	lw.onStatus(err)
+	return obj, err
+}
+
+func (lw *statusListWatch) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	w, err := lw.ListerWatcher.Watch(options)
+	lw.onStatus(err)
+	return w, err
+}
+
 // startEndpointSliceWatcher tracks changes to the EndpointSlicesList for the specified service.
-func startEndpointSliceWatcher(ctx context.Context, namespace, serviceName string, portName string, onUpdate func(newServers []string)) error {
+// Slices are kept in esStore, failed and succeeded List and Watch calls are reported to onStatus.
+// onSynced is called right after the update with the slices listed at start.
+func startEndpointSliceWatcher(ctx context.Context, namespace, serviceName string, portNames []string, esStore cache.Store, onUpdate func(newServers upstreamAddrs), onSynced func(), onStatus func(err error), log *logger) error {
 	// Create config for Kubernetes-client
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		return fmt.Errorf("[kubeforward] failed to create in-cluster config in namespace=%s, service-name %s: %w", namespace, serviceName, err)
+		return fmt.Errorf("failed to create in-cluster config in namespace=%s, service-name %s: %w", namespace, serviceName, err)
 	}
 
 	// Create client Kubernetes
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return fmt.Errorf("[kubeforward] failed to create Kubernetes client in namespace=%s, service-name %s: %w", namespace, serviceName, err)
+		return fmt.Errorf("failed to create Kubernetes client in namespace=%s, service-name %s: %w", namespace, serviceName, err)
 	}
 
 	// Create list/watch with filter by label
@@ -36,63 +79,68 @@ func startEndpointSliceWatcher(ctx context.Context, namespace, serviceName strin
 		},
 	)
 
-	// store all  slices
-	esStore := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	// Handlers and the update after sync take turns, so the last update has the latest slices
+	var updateMu sync.Mutex
+	update := func() {
+		updateMu.Lock()
+		defer updateMu.Unlock()
+		handleUpdate(esStore, portNames, serviceName, namespace, onUpdate, log)
+	}
 
 	handler := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			endpointSlice, ok := obj.(*v1.EndpointSlice)
 			if !ok {
-				log.Printf("[kubeforward] error hadling addition EndpointSlice for service=%s: Unexpected type %T\n", serviceName, obj)
+				log.Errorf("error handling addition of EndpointSlice for service=%s: unexpected type %T", serviceName, obj)
 				return
 			}
 			if err := esStore.Add(endpointSlice); err != nil {
-				log.Printf("[kubeforward] failed to add EndpointSlice for service=%s: %v\n", serviceName, err)
+				log.Errorf("failed to add EndpointSlice for service=%s: %v", serviceName, err)
 				return
 			}
-			handleUpdate(esStore, portName, serviceName, namespace, onUpdate)
-			log.Printf("[kubeforward] succusfuly added EndpointSlices for service=%s: %s\n", serviceName, endpointSlice.Name)
+			log.Debugf("added EndpointSlice for service=%s: %s", serviceName, endpointSlice.Name)
+			update()
 		},
 		UpdateFunc: func(old, new interface{}) {
 			oldEndpointSlice, ok1 := old.(*v1.EndpointSlice)
 			newEndpointSlice, ok2 := new.(*v1.EndpointSlice)
 			if !ok1 || !ok2 {
-				log.Printf("[kubeforward] error hadling update EndpointSlice for service=%s: Unexpected types: %T, %T\n", serviceName, old, new)
+				log.Errorf("error handling update of EndpointSlice for service=%s: unexpected types: %T, %T", serviceName, old, new)
 				return
 			}
 			if err := esStore.Update(newEndpointSlice); err != nil {
-				log.Printf("[kubeforward] failed to update EndpointSlice for service=%s: %v\n", serviceName, err)
+				log.Errorf("failed to update EndpointSlice for service=%s: %v", serviceName, err)
 				return
 			}
-			handleUpdate(esStore, portName, serviceName, namespace, onUpdate)
-			log.Printf("[kubeforward] succusfuly updated EndpointSlices for service=%s: EndpointSlice updated: %s -> %s\n", serviceName, oldEndpointSlice.Name, newEndpointSlice.Name)
+			log.Debugf("updated EndpointSlice for service=%s: %s -> %s", serviceName, oldEndpointSlice.Name, newEndpointSlice.Name)
+			update()
 		},
 		DeleteFunc: func(obj interface{}) {
 			endpointSlice, ok := obj.(*v1.EndpointSlice)
 			if !ok {
 				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
 				if !ok {
-					log.Printf("[kubeforward] error delete EndpointSlice for service=%s: Unexpected type %T\n", serviceName, obj)
+					log.Errorf("error handling deletion of EndpointSlice for service=%s: unexpected type %T", serviceName, obj)
 					return
 				}
 				endpointSlice, ok = tombstone.Obj.(*v1.EndpointSlice)
 				if !ok {
-					log.Printf("[kubeforward] error delete EndpointSlice for service=%s: Tombstone contained object of unexpected type %T\n", serviceName, tombstone.Obj)
+					log.Errorf("error handling deletion of EndpointSlice for service=%s: tombstone contained object of unexpected type %T", serviceName, tombstone.Obj)
 					return
 				}
 			}
 			if err := esStore.Delete(endpointSlice); err != nil {
-				log.Printf("[kubeforward] failed to delete EndpointSlice for service=%s: %v\n", serviceName, err)
+				log.Errorf("failed to delete EndpointSlice for service=%s: %v", serviceName, err)
 				return
 			}
-			handleUpdate(esStore, portName, serviceName, namespace, onUpdate)
-			log.Printf("[kubeforward] succusfuly seleted EndpointSlice for service=%s: EndpointSlice: %s\n", serviceName, endpointSlice.Name)
+			log.Debugf("deleted EndpointSlice for service=%s: %s", serviceName, endpointSlice.Name)
+			update()
 		},
 	}
 
 	// Create controller for EndpointSlice
 	informerOptions := cache.InformerOptions{
-		ListerWatcher:   listWatch,
+		ListerWatcher:   &statusListWatch{ListerWatcher: listWatch, onStatus: onStatus},
 		ObjectType:      &v1.EndpointSlice{},
 		Handler:         handler,
 		ResyncPeriod:    0,
@@ -108,27 +156,41 @@ func startEndpointSliceWatcher(ctx context.Context, namespace, serviceName strin
 
 	// Wait while informer end sync
 	if !cache.WaitForCacheSync(ctx.Done(), controller.HasSynced) {
-		return fmt.Errorf("[kubeforward] failed to sync EndpointSlices informer")
+		return fmt.Errorf("failed to sync EndpointSlices informer")
 	}
 
-	log.Printf("[kubeforward] EndpointSlice watcher for service %s in namespace %s: is running...", serviceName, namespace)
+	// Publish the synced state even without slices, queries must not wait for a first event
+	updateMu.Lock()
+	handleUpdate(esStore, portNames, serviceName, namespace, onUpdate, log)
+	onSynced()
+	updateMu.Unlock()
+
+	log.Infof("EndpointSlice watcher for service %s in namespace %s is running", serviceName, namespace)
 
 	return nil
 }
 
 // updateServers handle update EndpointSlice and callback
-func handleUpdate(store cache.Store, portName string, serviceName string, namespace string, onUpdate func(newServers []string)) {
+func handleUpdate(store cache.Store, portNames []string, serviceName string, namespace string, onUpdate func(newServers upstreamAddrs), log *logger) {
 
 	// Show all pslices in cache
 	items := store.List()
-	log.Printf("[kubeforward] Number of EndpointSlices in cache for service %s in namespace %s: %d", serviceName, namespace, len(items))
+	log.Debugf("number of EndpointSlices in cache for service %s in namespace %s: %d", serviceName, namespace, len(items))
 
+	// callback onUpdate
+	onUpdate(collectUpstreams(items, portNames, serviceName, namespace, log))
+}
+
+// collectUpstreams builds UDP and TCP upstream addresses from the ports matching portNames.
+// When the slices expose only one protocol, its addresses are used for both transports.
+func collectUpstreams(items []interface{}, portNames []string, serviceName string, namespace string, log *logger) upstreamAddrs {
 	// Collecting a list of addresses and ports
-	servers := make(map[string]struct{})
+	udpServers := make(map[string]upstreamEndpoint)
+	tcpServers := make(map[string]upstreamEndpoint)
 	for _, item := range items {
 		endpointSlice, ok := item.(*v1.EndpointSlice)
 		if !ok {
-			log.Printf("[kubeforward] Failed to cast object to EndpointSlice for service %s in namespace %s: %v", serviceName, namespace, item)
+			log.Errorf("failed to cast object to EndpointSlice for service %s in namespace %s: %v", serviceName, namespace, item)
 			continue
 		}
 
@@ -136,21 +198,67 @@ func handleUpdate(store cache.Store, portName string, serviceName string, namesp
 		for _, endpoint := range endpointSlice.Endpoints {
 			for _, address := range endpoint.Addresses {
 				for _, port := range endpointSlice.Ports {
-					if port.Port != nil && port.Name != nil && *port.Name == portName {
-						server := fmt.Sprintf("%s:%d", address, *port.Port)
-						servers[server] = struct{}{}
+					if port.Port == nil || port.Name == nil || !slices.Contains(portNames, *port.Name) {
+						continue
+					}
+					server := upstreamEndpoint{Addr: net.JoinHostPort(address, strconv.Itoa(int(*port.Port)))}
+					if endpoint.Hostname != nil {
+						server.Hostname = *endpoint.Hostname
+					}
+					if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+						server.Pod = endpoint.TargetRef.Name
+					}
+					if endpoint.NodeName != nil {
+						server.NodeName = *endpoint.NodeName
+					}
+					if endpoint.Zone != nil {
+						server.Zone = *endpoint.Zone
+					}
+					if port.AppProtocol != nil {
+						server.AppProtocol = *port.AppProtocol
+					}
+					// Protocol defaults to TCP when not set
+					if port.Protocol != nil && *port.Protocol == corev1.ProtocolUDP {
+						udpServers[server.Addr] = server
+					} else {
+						tcpServers[server.Addr] = server
 					}
 				}
 			}
 		}
 	}
 
-	// convert map in slice
-	serverList := make([]string, 0, len(servers))
-	for server := range servers {
+	upstreams := upstreamAddrs{
+		UDP: sortedEndpoints(udpServers),
+		TCP: sortedEndpoints(tcpServers),
+	}
+	if len(upstreams.UDP) == 0 {
+		upstreams.UDP = upstreams.TCP
+	}
+	if len(upstreams.TCP) == 0 {
+		upstreams.TCP = upstreams.UDP
+	}
+
+	return upstreams
+}
+
+// convert map in slice sorted by address
+func sortedEndpoints(servers map[string]upstreamEndpoint) []upstreamEndpoint {
+	serverList := make([]upstreamEndpoint, 0, len(servers))
+	for _, server := range servers {
 		serverList = append(serverList, server)
 	}
+	sort.Slice(serverList, func(i, j int) bool { return serverList[i].Addr < serverList[j].Addr })
 
-	// callback onUpdate
-	onUpdate(serverList)
+	return serverList
+}
+
+// addrs returns the addresses of the endpoints
+func addrs(endpoints []upstreamEndpoint) []string {
+	list := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		list = append(list, endpoint.Addr)
+	}
+
+	return list
 }
@@ -0,0 +1,103 @@
+package kubeforward
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/discovery/v1"
+)
+
+func TestCollectUpstreams(t *testing.T) {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dnsName, dnsTCPName, metricsName := "dns", "dns-tcp", "metrics"
+	port53, port5353, port9153 := int32(53), int32(5353), int32(9153)
+	hostname := "coredns-b"
+
+	tests := []struct {
+		name      string
+		ports     []v1.EndpointPort
+		portNames []string
+		expected  upstreamAddrs
+	}{
+		{
+			name: "Separate UDP and TCP ports",
+			ports: []v1.EndpointPort{
+				{Name: &dnsName, Protocol: &udp, Port: &port53},
+				{Name: &dnsTCPName, Protocol: &tcp, Port: &port5353},
+				{Name: &metricsName, Protocol: &tcp, Port: &port9153},
+			},
+			portNames: []string{"dns", "dns-tcp"},
+			expected: upstreamAddrs{
+				UDP: []upstreamEndpoint{{Addr: "10.0.0.1:53", Pod: "coredns-a"}, {Addr: "10.0.0.2:53", Hostname: "coredns-b"}},
+				TCP: []upstreamEndpoint{{Addr: "10.0.0.1:5353", Pod: "coredns-a"}, {Addr: "10.0.0.2:5353", Hostname: "coredns-b"}},
+			},
+		},
+		{
+			name: "Only UDP port is used for both transports",
+			ports: []v1.EndpointPort{
+				{Name: &dnsName, Protocol: &udp, Port: &port53},
+				{Name: &dnsTCPName, Protocol: &tcp, Port: &port5353},
+			},
+			portNames: []string{"dns"},
+			expected: upstreamAddrs{
+				UDP: []upstreamEndpoint{{Addr: "10.0.0.1:53", Pod: "coredns-a"}, {Addr: "10.0.0.2:53", Hostname: "coredns-b"}},
+				TCP: []upstreamEndpoint{{Addr: "10.0.0.1:53", Pod: "coredns-a"}, {Addr: "10.0.0.2:53", Hostname: "coredns-b"}},
+			},
+		},
+		{
+			name: "Port without protocol is TCP",
+			ports: []v1.EndpointPort{
+				{Name: &dnsName, Protocol: &udp, Port: &port53},
+				{Name: &dnsTCPName, Port: &port5353},
+			},
+			portNames: []string{"dns", "dns-tcp"},
+			expected: upstreamAddrs{
+				UDP: []upstreamEndpoint{{Addr: "10.0.0.1:53", Pod: "coredns-a"}, {Addr: "10.0.0.2:53", Hostname: "coredns-b"}},
+				TCP: []upstreamEndpoint{{Addr: "10.0.0.1:5353", Pod: "coredns-a"}, {Addr: "10.0.0.2:5353", Hostname: "coredns-b"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []interface{}{
+				&v1.EndpointSlice{
+					Endpoints: []v1.Endpoint{
+						{Addresses: []string{"10.0.0.2"}, Hostname: &hostname},
+						{Addresses: []string{"10.0.0.1"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "coredns-a"}},
+					},
+					Ports: test.ports,
+				},
+			}
+
+			upstreams := collectUpstreams(items, test.portNames, "d8-kube-dns", "kube-system", nil)
+
+			if !slices.Equal(upstreams.UDP, test.expected.UDP) {
+				t.Errorf("expected UDP upstreams %v, got %v", test.expected.UDP, upstreams.UDP)
+			}
+			if !slices.Equal(upstreams.TCP, test.expected.TCP) {
+				t.Errorf("expected TCP upstreams %v, got %v", test.expected.TCP, upstreams.TCP)
+			}
+		})
+	}
+}
+
+func TestCollectUpstreamsIPv6(t *testing.T) {
+	udp := corev1.ProtocolUDP
+	dnsName, port53 := "dns", int32(53)
+	items := []interface{}{
+		&v1.EndpointSlice{
+			AddressType: v1.AddressTypeIPv6,
+			Endpoints:   []v1.Endpoint{{Addresses: []string{"fd00::1"}}},
+			Ports:       []v1.EndpointPort{{Name: &dnsName, Protocol: &udp, Port: &port53}},
+		},
+	}
+
+	upstreams := collectUpstreams(items, []string{"dns"}, "d8-kube-dns", "kube-system", nil)
+
+	expected := []upstreamEndpoint{{Addr: "[fd00::1]:53"}}
+	if !slices.Equal(upstreams.UDP, expected) {
+		t.Errorf("expected UDP upstreams %v, got %v", expected, upstreams.UDP)
+	}
+}